@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/johnneerdael/ms-tools/mshal/edid"
+	"github.com/johnneerdael/ms-tools/mshal/mseeprom"
+)
+
+type EDIDImage struct {
+	Image string `optional help:"Use this EEPROM image instead of the device EEPROM."`
+}
+
+func (e *EDIDImage) NeedDevice() bool {
+	return e.Image == ""
+}
+
+func (e *EDIDImage) load(c *Context) ([]byte, int, *edid.EDID, error) {
+	data, _, err := eepromLoad(c, e.Image)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	offset, err := edid.Find(data)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	result, err := edid.Parse(data[offset:])
+	return data, offset, result, err
+}
+
+/* store replaces the EDID in the image and writes it back */
+func (e *EDIDImage) store(c *Context, orig []byte, offset int, result []byte) error {
+	data := append([]byte{}, orig...)
+	copy(data[offset:], result)
+
+	/* The EDID may be stored inside the firmware, which has a checksum */
+	if img, err := mseeprom.Parse(orig, 0); err == nil {
+		img.FixChecksum(data)
+	}
+
+	if e.Image != "" {
+		return os.WriteFile(e.Image, data, 0644)
+	}
+	return eepromWriteChanged(c, orig, data)
+}
+
+type EDIDInfo struct {
+	EDIDImage
+}
+
+func (i *EDIDInfo) Run(c *Context) error {
+	_, offset, e, err := i.load(c)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("EDID %s at %04x, %d bytes\n", e.Version(), offset, e.Len())
+	fmt.Printf("Manufacturer: %s, product %04x, serial %d, year %d\n", e.Manufacturer(), e.ProductCode(), e.Serial(), e.Year())
+	if name := e.Name(); name != "" {
+		fmt.Printf("Name: %s\n", name)
+	}
+
+	for _, m := range e.DetailedTimings() {
+		fmt.Printf("Detailed timing: %s\n", m)
+	}
+	for _, m := range e.StandardTimings() {
+		fmt.Printf("Standard timing: %dx%d@%d\n", m.Width, m.Height, m.Refresh)
+	}
+
+	cta, _ := e.CTA()
+	if cta == nil {
+		return nil
+	}
+
+	for _, m := range cta.VICs() {
+		native := ""
+		if m.Native {
+			native = " (native)"
+		}
+		if f, ok := edid.VICFormat(m.VIC); ok {
+			fmt.Printf("VIC %d: %s%s\n", m.VIC, f, native)
+		} else {
+			fmt.Printf("VIC %d%s\n", m.VIC, native)
+		}
+	}
+	for _, m := range cta.HDMIVICs() {
+		if f, ok := edid.HDMIVICFormat(m); ok {
+			fmt.Printf("HDMI VIC %d: %s\n", m, f)
+		} else {
+			fmt.Printf("HDMI VIC %d\n", m)
+		}
+	}
+	for _, m := range cta.SADs() {
+		fmt.Printf("Audio: %s\n", m)
+	}
+
+	return nil
+}
+
+type EDIDExtract struct {
+	EDIDImage
+	Filename string `arg name:"filename" help:"File to write EDID to."`
+}
+
+func (x *EDIDExtract) Run(c *Context) error {
+	_, _, e, err := x.load(c)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(x.Filename, e.Bytes(), 0644)
+}
+
+type EDIDWrite struct {
+	EDIDImage
+	Filename string `arg name:"filename" help:"File to read EDID from."`
+}
+
+func (w *EDIDWrite) Run(c *Context) error {
+	orig, offset, e, err := w.load(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(w.Filename)
+	if err != nil {
+		return err
+	}
+
+	n, err := edid.Parse(data)
+	if err != nil {
+		return err
+	}
+	if n.Len() != e.Len() {
+		return fmt.Errorf("New EDID is %d bytes, must be %d bytes to fit", n.Len(), e.Len())
+	}
+
+	return w.store(c, orig, offset, n.Bytes())
+}
+
+type EDIDRestrict struct {
+	EDIDImage
+	MaxWidth   int     `optional help:"Remove modes wider than this."`
+	MaxHeight  int     `optional help:"Remove modes taller than this."`
+	MaxRefresh float64 `optional help:"Remove modes with a higher refresh rate."`
+	DryRun     bool    `optional help:"Only show what would change."`
+}
+
+func (r *EDIDRestrict) Run(c *Context) error {
+	if r.MaxWidth == 0 && r.MaxHeight == 0 && r.MaxRefresh == 0 {
+		return errors.New("Specify at least one limit")
+	}
+
+	orig, offset, e, err := r.load(c)
+	if err != nil {
+		return err
+	}
+
+	changes, err := e.Restrict(edid.Limit{
+		MaxWidth:   r.MaxWidth,
+		MaxHeight:  r.MaxHeight,
+		MaxRefresh: r.MaxRefresh,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range changes {
+		fmt.Println(m)
+	}
+	if len(changes) == 0 {
+		fmt.Println("All modes are within the limits.")
+		return nil
+	}
+	if r.DryRun {
+		return nil
+	}
+
+	return r.store(c, orig, offset, e.Bytes())
+}
+
+type EDIDCmd struct {
+	Info     EDIDInfo     `cmd help:"Show the EDID stored in the EEPROM."`
+	Extract  EDIDExtract  `cmd help:"Save the EDID stored in the EEPROM to a file."`
+	Write    EDIDWrite    `cmd help:"Replace the EDID stored in the EEPROM."`
+	Restrict EDIDRestrict `cmd help:"Remove modes above the given limits from the EDID."`
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/johnneerdael/ms-tools/mshal"
+	"github.com/johnneerdael/ms-tools/mshal/mseeprom"
+)
+
+type EEPROMInfo struct {
+	Filename string `arg optional name:"filename" help:"EEPROM image to parse."`
+	Device   bool   `optional help:"Read the image from the device EEPROM."`
+}
+
+func (e *EEPROMInfo) NeedDevice() bool {
+	return e.Device
+}
+
+func eepromLoad(c *Context, filename string) ([]byte, int, error) {
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		return data, 0, err
+	}
+
+	if c.hal == nil {
+		return nil, 0, errors.New("Specify a file or use --device")
+	}
+
+	region := c.hal.MemoryRegionGet(mshal.MemoryRegionEEPROM)
+	data := make([]byte, region.GetLength())
+	n, err := region.Access(false, 0, data)
+	return data[:n], region.GetLength(), err
+}
+
+/* Save the EEPROM contents so a failed or unwanted write can be undone with eeprom-restore */
+func eepromBackup(data []byte) (string, error) {
+	return backupSave("eeprom", data)
+}
+
+func backupSave(kind string, data []byte) (string, error) {
+	filename := filepath.Join(CLI.BackupDir, fmt.Sprintf("%s-%s.bin", kind, time.Now().Format("20060102-150405")))
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	return filename, err
+}
+
+/* Write the pages of the EEPROM that differ from orig. The original contents are backed up
+ * first and restored if a page fails to verify. */
+func eepromWriteChanged(c *Context, orig []byte, image []byte) error {
+	if bytes.Equal(orig, image) {
+		fmt.Println("EEPROM is up to date.")
+		return nil
+	}
+
+	backup, err := eepromBackup(orig)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved backup to %s.\n", backup)
+
+	region := c.hal.MemoryRegionGet(mshal.MemoryRegionEEPROM)
+	written, skipped, err := mshal.EEPROMProgram(region, 0, image, orig)
+	if err != nil {
+		return fmt.Errorf("Failed to program EEPROM: %v", err)
+	}
+
+	fmt.Printf("Wrote and verified %d pages, %d pages unchanged.\n", written, skipped)
+	return nil
+}
+
+type EEPROMRestore struct {
+	Filename string `arg name:"filename" help:"Backup to write to the EEPROM."`
+}
+
+func (e *EEPROMRestore) Run(c *Context) error {
+	backup, err := os.ReadFile(e.Filename)
+	if err != nil {
+		return err
+	}
+
+	orig, _, err := eepromLoad(c, "")
+	if err != nil {
+		return err
+	}
+	if len(backup) > len(orig) {
+		return fmt.Errorf("Backup is larger than EEPROM (%d > %d bytes)", len(backup), len(orig))
+	}
+
+	return eepromWriteChanged(c, orig[:len(backup)], backup)
+}
+
+type EEPROMProbe struct {
+}
+
+func (e *EEPROMProbe) Run(c *Context) error {
+	g, err := c.hal.EEPROMProbe()
+	if err != nil {
+		return err
+	}
+	if g.Devices == 0 {
+		return errors.New("No EEPROM found")
+	}
+
+	fmt.Printf("I2C addresses: %d (0x50-0x%02x)\n", g.Devices, 0x50+g.Devices-1)
+	fmt.Printf("Size:          %d bytes (confidence: %s)\n", g.Size, g.SizeConfidence)
+	fmt.Printf("Addressing:    %d-bit (confidence: %s)\n", 8*g.AddrBytes, g.AddrConfidence)
+	fmt.Printf("Page size:     %d bytes (assumed: typical for this size, can't be measured without writing, override with --eeprom-page-size)\n", g.PageSize)
+	return nil
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+func (e *EEPROMInfo) Run(c *Context) error {
+	data, eepromSize, err := eepromLoad(c, e.Filename)
+	if err != nil {
+		return err
+	}
+
+	img, err := mseeprom.Parse(data, eepromSize)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Chip:      %s (magic %04x)\n", img.Chip, img.Magic())
+	fmt.Printf("Code:      %d bytes (max %d, %d leaves the I2C buffer of the patch free)\n", len(img.Code), img.Chip.MaxCodeLen(), img.Chip.MaxPatchableCodeLen())
+	fmt.Printf("Checksum:  %v\n", img.HasChecksum)
+	fmt.Printf("Hooks:     main=%s (%04x) irq=%s (%04x)\n", onOff(img.HookEnabled(false)), img.Chip.HookAddr(false), onOff(img.HookEnabled(true)), img.Chip.HookAddr(true))
+	if eepromSize > 0 {
+		fmt.Printf("EEPROM:    %d of %d bytes used by firmware\n", img.Len(), eepromSize)
+	}
+
+	cfg := img.Config()
+	if cfg.Name != "" {
+		fmt.Printf("Name:      %q\n", cfg.Name)
+	}
+	fmt.Println("Options:")
+	fmt.Print(hexdump(4, cfg.Options, nil))
+	if len(cfg.Reserved) > 0 {
+		fmt.Println("Reserved:")
+		fmt.Print(hexdump(4+len(cfg.Options), cfg.Reserved, nil))
+	}
+
+	used := 0
+	for _, m := range img.Trailer {
+		if m != 0xff {
+			used++
+		}
+	}
+	fmt.Printf("Trailer:   %d bytes, %d not blank\n", len(img.Trailer), used)
+
+	return nil
+}
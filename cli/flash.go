@@ -1,56 +1,250 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
+	"time"
+
+	"github.com/johnneerdael/ms-tools/mshal"
+	"github.com/johnneerdael/ms-tools/mshal/ms213x"
 )
 
-type FlashMemoryRegion struct {
-	dev *hidDeviceWrapper
+type FlashErase struct {
+	Addr   int  `arg optional name:"addr" type:"int" help:"First address to erase, a multiple of the 4KB sector size."`
+	Length int  `arg optional name:"length" type:"int" help:"Number of bytes to erase, omit for the rest of the flash."`
+	Chip   bool `optional help:"Erase the whole flash with a single command."`
 }
 
-func (r *FlashMemoryRegion) GetLength() int {
-	return 0x10000 // 64KB
+func (l *FlashErase) Run(c *Context) error {
+	if l.Chip {
+		if err := c.hal.FlashEraseChip(); err != nil {
+			return err
+		}
+		fmt.Println("Flash erased.")
+		return nil
+	}
+
+	region := c.hal.MemoryRegionGet(mshal.MemoryRegionFLASH)
+	if region == nil {
+		return errors.New("Device has no flash")
+	}
+	if l.Length == 0 {
+		l.Length = region.GetLength() - l.Addr
+	}
+
+	if err := c.hal.FlashErase(l.Addr, l.Length); err != nil {
+		return err
+	}
+	fmt.Printf("Erased %d bytes of FLASH at %06x.\n", l.Length, l.Addr)
+	return nil
 }
 
-func (r *FlashMemoryRegion) Access(write bool, addr int, buf []byte) (int, error) {
-	if addr >= r.GetLength() {
-		return 0, fmt.Errorf("address out of range")
+type FlashInfo struct {
+}
+
+func (l *FlashInfo) Run(c *Context) error {
+	info, err := c.hal.FlashInfo()
+	if err != nil {
+		return err
 	}
 
-	if write {
-		return 0, fmt.Errorf("flash write not implemented yet")
+	fmt.Printf("Flash:       %s\n", info)
+	for _, m := range info.EraseTypes {
+		fmt.Printf("Erase:       %d bytes (command %02x)\n", m.Size, m.Opcode)
 	}
+	return nil
+}
 
-	// Read in pages
-	total := 0
-	for len(buf) > 0 {
-		page := uint16(addr >> 8)
-		offset := uint8(addr & 0xff)
+type FlashUpdate struct {
+	Filename string        `arg name:"filename" help:"Flash image to write."`
+	Force    bool          `optional help:"Write images that are not a known build."`
+	Timeout  time.Duration `optional default:"60s" help:"Time to wait for the device to be replugged after the update."`
+}
 
-		n, err := r.dev.readFlashPage(page, offset, buf)
-		if err != nil {
-			return total, err
+func (l *FlashUpdate) Run(c *Context) error {
+	data, err := os.ReadFile(l.Filename)
+	if err != nil {
+		return err
+	}
+
+	if err := ms213x.CheckImage(data); err != nil {
+		return fmt.Errorf("Invalid image: %w", err)
+	}
+	img, err := ms213x.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	build := img.Identify()
+	fmt.Printf("Image: %d bytes, %s\n", len(data), build)
+	if build.Name == "" && !build.Patched && !l.Force {
+		return errors.New("Image is not a known build, use --force to write it anyway")
+	}
+
+	region := c.hal.MemoryRegionGet(mshal.MemoryRegionFLASH)
+	if region == nil {
+		return errors.New("Device has no flash")
+	}
+	if len(data) > region.GetLength() {
+		return fmt.Errorf("Image is %d bytes, the flash only holds %d", len(data), region.GetLength())
+	}
+
+	sector := 4096
+	if info, err := c.hal.FlashInfo(); err == nil && len(info.EraseTypes) > 0 {
+		sector = info.EraseTypes[0].Size
+	}
+
+	orig, err := flashBackup(region, len(data), sector)
+	if err != nil {
+		return err
+	}
+	backup, err := backupSave("flash", orig)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved backup of %d bytes to %s.\n", len(orig), backup)
+
+	/* Put the old contents back if anything goes wrong from here */
+	failed := func(err error) error {
+		fmt.Printf("Update failed: %v\nRestoring the backup.\n", err)
+		if restoreErr := flashRestore(region, orig, sector); restoreErr != nil {
+			return fmt.Errorf("%w, restoring the backup failed too (%v), write it with write-file FLASH 0 %s", err, restoreErr, backup)
 		}
-		if n == 0 {
-			break
+		return fmt.Errorf("%w, the backup was restored", err)
+	}
+
+	if err := c.hal.FlashErase(0, (len(data)+sector-1)/sector*sector); err != nil {
+		return failed(fmt.Errorf("Failed to erase flash: %w", err))
+	}
+
+	for addr := 0; addr < len(data); addr += sector {
+		end := min(addr+sector, len(data))
+		if _, err := region.Access(true, addr, data[addr:end]); err != nil {
+			return failed(fmt.Errorf("Failed to program flash at %06x: %w", addr, err))
 		}
+		fmt.Printf("\rWrote %d of %d bytes", end, len(data))
+	}
+	fmt.Println()
 
-		total += n
-		addr += n
-		buf = buf[n:]
+	verify := make([]byte, len(data))
+	if _, err := readProgress(region, 0, verify); err != nil {
+		return failed(err)
 	}
+	if !bytes.Equal(verify, data) {
+		return failed(errors.New("Flash contents do not match the image"))
+	}
+	if err := ms213x.CheckImage(verify); err != nil {
+		return failed(fmt.Errorf("Flash image is invalid: %w", err))
+	}
+	fmt.Println("Flash verified.")
 
-	return total, nil
+	if err := flashRestart(c, l.Timeout); err != nil {
+		return err
+	}
+
+	if build.Patched && !c.hal.FirmwareCanCall() {
+		return errors.New("New firmware did not announce itself at 0x7b00")
+	}
+	if c.hal.FirmwareCanCall() {
+		fmt.Println("New firmware is running and supports calling functions.")
+	} else {
+		fmt.Println("Device is back.")
+	}
+	return nil
 }
 
-func (r *FlashMemoryRegion) GetParent() (interface{}, int) {
-	return nil, 0
+/* flashBackup reads the sectors an image of length bytes is written to. It goes on over the old
+ * firmware and the data behind it, up to the first erased sector, so the backup holds all of it. */
+func flashBackup(region mshal.MemoryRegion, length int, sector int) ([]byte, error) {
+	var hdr [ms213x.HeaderLen]byte
+	if _, err := region.Access(false, 0, hdr[:]); err != nil {
+		return nil, err
+	}
+	if ms213x.Magic(binary.BigEndian.Uint16(hdr[:])).Valid() {
+		length = max(length, ms213x.HeaderLen+int(binary.BigEndian.Uint16(hdr[2:]))+ms213x.ChecksumLen)
+	}
+
+	var backup []byte
+	buf := make([]byte, sector)
+	for addr := 0; addr+sector <= region.GetLength(); addr += sector {
+		if _, err := region.Access(false, addr, buf); err != nil {
+			return nil, err
+		}
+		if addr >= length && bytes.Count(buf, []byte{0xff}) == len(buf) {
+			break
+		}
+		backup = append(backup, buf...)
+		fmt.Printf("\rBacked up %d bytes", len(backup))
+	}
+	fmt.Println()
+
+	return backup, nil
 }
 
-func (r *FlashMemoryRegion) GetName() string {
-	return "FLASH"
+/* flashRestore writes the backup over a failed update and reads it back */
+func flashRestore(region mshal.MemoryRegion, backup []byte, sector int) error {
+	for addr := 0; addr < len(backup); addr += sector {
+		if _, err := region.Access(true, addr, backup[addr:min(addr+sector, len(backup))]); err != nil {
+			return err
+		}
+	}
+
+	verify := make([]byte, len(backup))
+	if _, err := readProgress(region, 0, verify); err != nil {
+		return err
+	}
+	if !bytes.Equal(verify, backup) {
+		return errors.New("flash contents do not match the backup")
+	}
+	return nil
 }
 
-func (r *FlashMemoryRegion) GetAlignment() int {
-	return 1
+/* flashRestart asks the user to power cycle the device and opens it again once it is back. A chip
+ * reset can't be triggered over HID, jumping to the reset vector would leave the USB state as it
+ * is. The device must disappear first, otherwise the old firmware could be mistaken for the new one. */
+func flashRestart(c *Context, timeout time.Duration) error {
+	fmt.Println("Unplug the device and plug it back in to start the new firmware.")
+
+	c.dev.Close()
+	c.dev = nil
+	c.hal = nil
+
+	gone := false
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		/* Poll quickly until it is gone, a reset only takes a moment */
+		if gone {
+			time.Sleep(time.Second)
+		} else {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		dev, err := OpenDevice()
+		if err != nil {
+			gone = true
+			continue
+		}
+		if !gone {
+			dev.Close()
+			continue
+		}
+
+		hal, err := newHAL(dev, false)
+		if err != nil {
+			dev.Close()
+			continue
+		}
+
+		c.dev = dev
+		c.hal = hal
+		return nil
+	}
+
+	if !gone {
+		return fmt.Errorf("Device was not unplugged within %v", timeout)
+	}
+	return fmt.Errorf("Device did not come back within %v", timeout)
 }
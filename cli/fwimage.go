@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/johnneerdael/ms-tools/mshal/ms213x"
+)
+
+type FWImage struct {
+	Info    FWImageInfo    `cmd help:"Show the header and sections of an MS213x flash image."`
+	Check   FWImageCheck   `cmd help:"Verify the code length and checksums of an MS213x flash image."`
+	Fix     FWImageFix     `cmd help:"Update the code length and checksums of an MS213x flash image."`
+	Extract FWImageExtract `cmd help:"Write the header, code and trailer of an MS213x flash image to separate files."`
+}
+
+func fwImageLoad(filename string) (*ms213x.Image, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ms213x.Parse(data)
+}
+
+/* Ranges of 4KB sectors that are not blank, flash dumps usually store data far behind the code */
+func fwImageUsedSectors(offset int, data []byte) [][2]int {
+	const sector = 0x1000
+
+	var ranges [][2]int
+	for i := 0; i < len(data); i += sector {
+		end := min(i+sector, len(data))
+		blank := true
+		for _, m := range data[i:end] {
+			if m != 0xff {
+				blank = false
+				break
+			}
+		}
+		if blank {
+			continue
+		}
+
+		if n := len(ranges); n > 0 && ranges[n-1][1] == offset+i {
+			ranges[n-1][1] = offset + end
+		} else {
+			ranges = append(ranges, [2]int{offset + i, offset + end})
+		}
+	}
+	return ranges
+}
+
+type FWImageInfo struct {
+	Filename string `arg name:"filename" help:"Flash image to parse."`
+}
+
+func (f *FWImageInfo) NeedDevice() bool {
+	return false
+}
+
+func (f *FWImageInfo) Run(c *Context) error {
+	img, err := fwImageLoad(f.Filename)
+	if err != nil {
+		return err
+	}
+
+	hdrSum, codeSum := img.Checksums()
+
+	fmt.Printf("Magic:     %s\n", img.Magic())
+	fmt.Printf("Code:      %d bytes at 0x%04x\n", len(img.Code), ms213x.HeaderLen)
+	fmt.Printf("Build:     %s\n", img.Identify())
+	if name := img.Name(); name != "" {
+		fmt.Printf("Name:      %q\n", name)
+	}
+	fmt.Printf("Checksums: header %04x %s, code %04x %s\n", img.HeaderSum, okMismatch(img.HeaderSum, hdrSum), img.CodeSum, okMismatch(img.CodeSum, codeSum))
+
+	fmt.Println("Header:")
+	fmt.Print(hexdump(0, img.Header, nil))
+
+	fmt.Printf("Trailer:   %d bytes\n", len(img.Trailer))
+	for _, r := range fwImageUsedSectors(img.Len(), img.Trailer) {
+		fmt.Printf("  Data at 0x%06x-0x%06x\n", r[0], r[1]-1)
+	}
+
+	return nil
+}
+
+func okMismatch(stored uint16, calculated uint16) string {
+	if stored == calculated {
+		return "(ok)"
+	}
+	return fmt.Sprintf("(mismatch, calculated %04x)", calculated)
+}
+
+type FWImageCheck struct {
+	Filename string `arg name:"filename" help:"Flash image to verify."`
+}
+
+func (f *FWImageCheck) NeedDevice() bool {
+	return false
+}
+
+func (f *FWImageCheck) Run(c *Context) error {
+	img, err := fwImageLoad(f.Filename)
+	if err != nil {
+		return err
+	}
+	if err := img.Check(); err != nil {
+		return err
+	}
+
+	fmt.Println("Image is valid.")
+	return nil
+}
+
+type FWImageFix struct {
+	Filename string `arg name:"filename" help:"Flash image to fix."`
+	Output   string `optional help:"Write the fixed image here instead of updating the input."`
+}
+
+func (f *FWImageFix) NeedDevice() bool {
+	return false
+}
+
+func (f *FWImageFix) Run(c *Context) error {
+	img, err := fwImageLoad(f.Filename)
+	if err != nil {
+		return err
+	}
+
+	if img.Check() == nil && f.Output == "" {
+		fmt.Println("Image is already valid.")
+		return nil
+	}
+
+	img.Fix()
+
+	output := f.Output
+	if output == "" {
+		output = f.Filename
+	}
+	if err := os.WriteFile(output, img.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s with header checksum %04x and code checksum %04x.\n", output, img.HeaderSum, img.CodeSum)
+	return nil
+}
+
+type FWImageExtract struct {
+	Filename string `arg name:"filename" help:"Flash image to split."`
+	Prefix   string `arg optional name:"prefix" help:"Prefix of the output files, defaults to the image name."`
+}
+
+func (f *FWImageExtract) NeedDevice() bool {
+	return false
+}
+
+func (f *FWImageExtract) Run(c *Context) error {
+	img, err := fwImageLoad(f.Filename)
+	if err != nil {
+		return err
+	}
+
+	prefix := f.Prefix
+	if prefix == "" {
+		prefix = f.Filename
+	}
+
+	sections := []struct {
+		name string
+		data []byte
+	}{
+		{"header", img.Header},
+		{"code", img.Code},
+		{"trailer", img.Trailer},
+	}
+
+	for _, s := range sections {
+		if len(s.data) == 0 {
+			continue
+		}
+
+		filename := fmt.Sprintf("%s-%s.bin", prefix, s.name)
+		if err := os.WriteFile(filename, s.data, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d bytes of %s to %s.\n", len(s.data), s.name, filename)
+	}
+
+	return nil
+}
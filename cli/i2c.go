@@ -3,60 +3,141 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
+	"strconv"
+	"strings"
 
-	"github.com/BertoldVdb/ms-tools/mshal"
+	"github.com/johnneerdael/ms-tools/mshal"
 )
 
 type I2CScan struct {
+	Mode string `optional enum:"auto,quick,read" default:"auto" help:"Probe with a quick write, a byte read or pick per address like i2cdetect (auto)."`
+	All  bool   `optional help:"Also probe the reserved addresses 00-07 and 78-7F."`
+
+	CheckShared bool `optional help:"Also read ID registers at addresses shared with devices without registers, eg: ADV7513 at 0x39 where a PCF8574A would get its outputs written."`
+}
+
+var i2cProbeModes = map[string]mshal.I2CProbeMode{
+	"auto":  mshal.I2CProbeAuto,
+	"quick": mshal.I2CProbeQuick,
+	"read":  mshal.I2CProbeRead,
 }
 
 func (l *I2CScan) Run(c *Context) error {
+	var found []uint8
+
 	fmt.Printf("Detected I2C devices:\r\n   ")
 	for i := 0; i < 16; i++ {
 		fmt.Printf("%02X ", i)
 	}
 	for i := byte(0); i < 0x80; i++ {
-		ok, err := c.hal.I2CTransfer(i, []byte{0}, nil)
-		if err != nil {
-			return err
-		}
-
 		if i&15 == 0 {
 			fmt.Printf("\r\n%02x ", i)
 		}
 
+		if !l.All && (i < 0x08 || i > 0x77) {
+			fmt.Printf("   ")
+			continue
+		}
+
+		ok, err := c.hal.I2CProbe(i, i2cProbeModes[l.Mode])
+		if err != nil {
+			return err
+		}
+
 		if ok {
 			fmt.Printf("%02X ", i)
+			found = append(found, i)
 		} else {
 			fmt.Printf("-- ")
 		}
 	}
 	fmt.Println()
+
+	if len(found) > 0 {
+		fmt.Println()
+	}
+	for _, m := range found {
+		fmt.Printf("%02x: %s\n", m, i2cIdentify(c, m, l.CheckShared))
+	}
 	return nil
 }
 
 type I2CTransfer struct {
 	Addr int `arg name:"addr" help:"I2C device address" type:"int"`
 
-	Write string `optional help:"Hex string to write to device"`
-	Read  int    `optional help:"Number of bytes to read back"`
+	Write  string `optional help:"Hex string to write to device"`
+	Read   int    `optional help:"Number of bytes to read back"`
+	NoStop bool   `optional help:"Do not release the bus at the end of the transfer"`
+
+	Segments []string `arg optional name:"segments" help:"Messages sent with a repeated start in between: w:HEX writes, r:N reads, w@ADDR:HEX and r@ADDR:N use another device."`
+}
+
+func (l *I2CTransfer) parseSegment(segment string) (mshal.I2CMessage, error) {
+	msg := mshal.I2CMessage{Addr: byte(l.Addr)}
+
+	kind, value, ok := strings.Cut(segment, ":")
+	if !ok {
+		return msg, fmt.Errorf("Invalid segment %s", segment)
+	}
+
+	if prefix, addr, ok := strings.Cut(kind, "@"); ok {
+		v, err := strconv.ParseUint(addr, 0, 7)
+		if err != nil {
+			return msg, err
+		}
+		msg.Addr = byte(v)
+		kind = prefix
+	}
+
+	switch kind {
+	case "w":
+		data, err := hex.DecodeString(value)
+		msg.Data = data
+		return msg, err
+	case "r":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return msg, err
+		}
+		msg.Read = true
+		msg.Data = make([]byte, n)
+		return msg, nil
+	}
+
+	return msg, fmt.Errorf("Invalid segment %s", segment)
 }
 
 func (l *I2CTransfer) Run(c *Context) error {
-	wrBuf, err := hex.DecodeString(l.Write)
-	if err != nil {
-		return err
+	var msgs []mshal.I2CMessage
+
+	if l.Write != "" {
+		wrBuf, err := hex.DecodeString(l.Write)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, mshal.I2CMessage{Addr: byte(l.Addr), Data: wrBuf})
+	}
+	if l.Read > 0 {
+		msgs = append(msgs, mshal.I2CMessage{Addr: byte(l.Addr), Read: true, Data: make([]byte, l.Read)})
 	}
 
-	rdBuf := make([]byte, l.Read)
-	ok, err := c.hal.I2CTransfer(byte(l.Addr), wrBuf, rdBuf)
-	if err != nil {
-		return err
+	for _, m := range l.Segments {
+		msg, err := l.parseSegment(m)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
 	}
-	if !ok {
-		return mshal.ErrorNoAck
+
+	if err := c.hal.I2CTransferMessages(msgs, l.NoStop); err != nil {
+		return err
 	}
 
-	fmt.Println(hexdump(0, rdBuf, nil))
+	for i, m := range msgs {
+		if m.Read {
+			fmt.Printf("Message %d, read %d bytes from %02x:\n", i, len(m.Data), m.Addr)
+			fmt.Println(hexdump(0, m.Data, nil))
+		}
+	}
 	return nil
 }
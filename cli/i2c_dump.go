@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/johnneerdael/ms-tools/mshal"
+)
+
+type I2CRegisters struct {
+	Addr int `arg name:"addr" help:"I2C device address" type:"int"`
+
+	RegBits     int  `optional enum:"8,16" default:"8" help:"Register address width in bits (8 or 16)."`
+	Start       int  `optional type:"int" help:"First register to read."`
+	Count       int  `optional type:"int" help:"Number of registers to read, omit for the rest of the register space."`
+	NoIncrement bool `optional help:"Address every register separately, for devices that do not auto-increment."`
+}
+
+/* Stay well within a single batched transfer */
+const i2cDumpChunk = 32
+
+func (r *I2CRegisters) read(c *Context, count int) ([]byte, error) {
+	space := 1 << r.RegBits
+	if count == 0 {
+		count = space - r.Start
+	}
+	if r.Start < 0 || count < 0 || r.Start+count > space {
+		return nil, fmt.Errorf("Register range exceeds the %d-bit register space", r.RegBits)
+	}
+
+	chunk := i2cDumpChunk
+	if r.NoIncrement {
+		chunk = 1
+	}
+
+	buf := make([]byte, count)
+	for offset := 0; offset < count; offset += chunk {
+		end := offset + chunk
+		if end > count {
+			end = count
+		}
+
+		reg := r.Start + offset
+		wrBuf := []byte{byte(reg)}
+		if r.RegBits == 16 {
+			wrBuf = []byte{byte(reg >> 8), byte(reg)}
+		}
+
+		msgs := []mshal.I2CMessage{
+			{Addr: byte(r.Addr), Data: wrBuf},
+			{Addr: byte(r.Addr), Read: true, Data: buf[offset:end]},
+		}
+		if err := c.hal.I2CTransferMessages(msgs, false); err != nil {
+			return nil, fmt.Errorf("Register %04x: %w", reg, err)
+		}
+	}
+
+	return buf, nil
+}
+
+type I2CDump struct {
+	Registers I2CRegisters `embed`
+	Filename  string       `optional help:"File to write dump to."`
+}
+
+func (l *I2CDump) Run(c *Context) error {
+	buf, err := l.Registers.read(c, l.Registers.Count)
+	if err != nil {
+		return err
+	}
+
+	if l.Filename != "" {
+		return ioutil.WriteFile(l.Filename, buf, 0644)
+	}
+
+	fmt.Println(hexdump(l.Registers.Start, buf, nil))
+	return nil
+}
+
+type I2CDiff struct {
+	Registers I2CRegisters `embed`
+	Filename  string       `arg name:"filename" help:"Dump to compare against, made with i2c-dump using the same start register."`
+}
+
+func (l *I2CDiff) Run(c *Context) error {
+	saved, err := ioutil.ReadFile(l.Filename)
+	if err != nil {
+		return err
+	}
+
+	count := l.Registers.Count
+	if count == 0 {
+		count = len(saved)
+	}
+	if count > len(saved) {
+		return errors.New("Dump is shorter than the requested register range")
+	}
+
+	buf, err := l.Registers.read(c, count)
+	if err != nil {
+		return err
+	}
+
+	changed := 0
+	mark := make([]bool, len(buf))
+	for i, m := range buf {
+		if m != saved[i] {
+			mark[i] = true
+			changed++
+		}
+	}
+
+	fmt.Println(hexdump(l.Registers.Start, buf, mark))
+	fmt.Printf("%d of %d registers changed.\n", changed, len(buf))
+	return nil
+}
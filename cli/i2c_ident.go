@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/johnneerdael/ms-tools/mshal"
+)
+
+/* i2cKnownDevice describes devices that are commonly found at a range of addresses. If check is
+ * set it must confirm the device, otherwise the entry is only a guess based on the address.
+ * Checks of shared entries write to addresses used by devices without registers, they only run
+ * when asked for. */
+type i2cKnownDevice struct {
+	first  uint8
+	last   uint8
+	name   string
+	check  func(c *Context, addr uint8) (string, bool)
+	shared bool
+}
+
+/* i2cCheckID matches the contents of an ID register. Devices without registers (eg: PCF8574)
+ * must not be checked this way, as the register address would be written to their outputs. */
+func i2cCheckID(reg uint8, id ...byte) func(c *Context, addr uint8) (string, bool) {
+	return func(c *Context, addr uint8) (string, bool) {
+		buf, ok := i2cReadID(c, addr, reg, len(id))
+		return "", ok && bytes.Equal(buf, id)
+	}
+}
+
+func i2cReadID(c *Context, addr uint8, reg uint8, n int) ([]byte, bool) {
+	buf := make([]byte, n)
+	err := c.hal.I2CTransferMessages([]mshal.I2CMessage{
+		{Addr: addr, Data: []byte{reg}},
+		{Addr: addr, Read: true, Data: buf},
+	}, false)
+	return buf, err == nil
+}
+
+/* ITE chips start with the vendor ID 'IT' followed by the device ID, both little endian */
+func i2cCheckITE(c *Context, addr uint8) (string, bool) {
+	buf, ok := i2cReadID(c, addr, 0, 4)
+	if !ok || buf[0] != 0x54 || buf[1] != 0x49 {
+		return "", false
+	}
+	return fmt.Sprintf("ITE IT%02X%02X HDMI chip", buf[3], buf[2]), true
+}
+
+var i2cKnownDevices = []i2cKnownDevice{
+	{0x48, 0x49, "", i2cCheckITE, false},
+	{0x4c, 0x4c, "ADV7611 HDMI receiver", i2cCheckID(0xea, 0x20, 0x51), false},
+	{0x39, 0x39, "ADV7513 HDMI transmitter", i2cCheckID(0xf5, 0x75, 0x11), true},
+	{0x76, 0x77, "BMP280 pressure sensor", i2cCheckID(0xd0, 0x58), false},
+	{0x76, 0x77, "BME280 environmental sensor", i2cCheckID(0xd0, 0x60), false},
+	{0x76, 0x77, "BME680 gas sensor", i2cCheckID(0xd0, 0x61), false},
+	{0x68, 0x69, "MPU-6050 motion sensor", i2cCheckID(0x75, 0x68), false},
+
+	{0x0f, 0x0f, "TC358743 HDMI to CSI bridge", nil, false},
+	{0x1e, 0x1e, "HMC5883L magnetometer", nil, false},
+	{0x20, 0x27, "PCF8574/MCP23008 I/O expander", nil, false},
+	{0x39, 0x39, "PCF8574A I/O expander or ADV7513 HDMI transmitter", nil, false},
+	{0x38, 0x3f, "PCF8574A I/O expander", nil, false},
+	{0x3c, 0x3d, "SSD1306 OLED display", nil, false},
+	{0x40, 0x40, "INA219 current monitor or HTU21D/Si7021 humidity sensor", nil, false},
+	{0x44, 0x45, "SHT3x humidity sensor", nil, false},
+	{0x48, 0x4f, "LM75/TMP102 temperature sensor", nil, false},
+	{0x50, 0x57, "24Cxx EEPROM", nil, false},
+	{0x68, 0x68, "DS1307/DS3231 real time clock", nil, false},
+	{0x76, 0x77, "BMP180/MS5611 pressure sensor", nil, false},
+}
+
+/* i2cIdentify returns a description of the device at addr, confirmed entries take precedence */
+func i2cIdentify(c *Context, addr uint8, checkShared bool) string {
+	for _, m := range i2cKnownDevices {
+		if addr < m.first || addr > m.last || m.check == nil || (m.shared && !checkShared) {
+			continue
+		}
+		if name, ok := m.check(c, addr); ok {
+			if name == "" {
+				name = m.name
+			}
+			return name
+		}
+	}
+
+	for _, m := range i2cKnownDevices {
+		if addr >= m.first && addr <= m.last && m.check == nil {
+			if addr == 0x50 && c.hal.GetDeviceType() != "MS2130" {
+				return "24Cxx EEPROM (boot EEPROM)"
+			}
+			return m.name + "?"
+		}
+	}
+
+	return "unknown"
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/johnneerdael/ms-tools/gohid"
@@ -10,9 +12,8 @@ import (
 )
 
 type Context struct {
-	dev   gohid.HIDDevice
-	hal   *mshal.HAL
-	flash *FlashMemoryRegion
+	dev gohid.HIDDevice
+	hal *mshal.HAL
 }
 
 var CLI struct {
@@ -23,12 +24,29 @@ var CLI struct {
 	RawPath  string `optional help:"The USB Device Path."`
 	LogLevel int    `optional help:"Higher values give more output."`
 
-	NoPatch    bool `optional help:"Do not attempt to patch running firmware."`
-	EEPROMSize int  `optional help:"Specify EEPROM size to skip autodetection."`
-	NoFirmware bool `optional help:"Do not use firmware in EEPROM."`
+	NoPatch    bool   `optional help:"Do not attempt to patch running firmware."`
+	EEPROMSize int    `optional help:"Specify EEPROM size to skip autodetection."`
+	NoFirmware bool   `optional help:"Do not use firmware in EEPROM."`
+	BackupDir  string `optional help:"Directory where EEPROM backups are stored before writing." default:"."`
+
+	EEPROMPageSize     int           `optional help:"EEPROM page size in bytes, overrides the typical value for the detected size."`
+	EEPROMAddrBits     int           `optional enum:"0,8,16" default:"0" help:"EEPROM address width in bits (8 or 16), 0 derives it from the size."`
+	EEPROMWriteTimeout time.Duration `optional help:"Maximum time an EEPROM write cycle may take (eg: 10ms)."`
+
+	I2CSpeed          int           `optional name:"i2c-speed" help:"Bit-bang the I2C bus at this speed in Hz instead of using the ROM functions (eg: 100000)."`
+	I2CStretchTimeout time.Duration `optional name:"i2c-stretch-timeout" help:"Maximum time a device may stretch the I2C clock when bit-banging (eg: 5ms)."`
+
+	SPIPins  []int `optional name:"spi-pins" help:"GPIOs used for SPI SCK, MOSI, MISO and CS (eg: 0,1,2,3)."`
+	SPISpeed int   `optional name:"spi-speed" help:"SPI clock speed in Hz, omit for as fast as possible."`
+
+	PreflightOnly bool   `optional help:"Check if the running firmware can be patched and exit, without patching it."`
+	ROMDump       string `optional name:"rom-dump" help:"ROM dump (from dump-rom) used to check the ROM functions before patching."`
 
 	ListDev ListHIDCmd `cmd help:"List devices."`
 
+	/* Only reachable with --preflight-only */
+	Preflight PreflightCmd `cmd hidden default:"1"`
+
 	ListRegions MEMIOListRegions  `cmd help:"List available memory regions."`
 	Read        MEMIOReadCmd      `cmd help:"Read and dump memory."`
 	Write       MEMIOWriteCmd     `cmd help:"Write value to memory."`
@@ -38,8 +56,27 @@ var CLI struct {
 
 	DumpROM DumpROM `cmd help:"Dump ROM (code) to file by uploading custom code."`
 
+	FlashInfo   FlashInfo   `cmd name:"flash-info" help:"Identify the MS2130 flash from its JEDEC ID and SFDP tables."`
+	FlashErase  FlashErase  `cmd name:"flash-erase" help:"Erase sectors of the MS2130 flash."`
+	FlashUpdate FlashUpdate `cmd name:"flash-update" help:"Back up the MS2130 flash, write a firmware image, verify it and wait for the replugged device."`
+
+	FWImage FWImage `cmd name:"fw-image" help:"Inspect, check, fix and split MS213x flash images."`
+
+	PatchPersist PatchPersist `cmd name:"patch-persist" help:"Store the patch in the EEPROM user firmware."`
+
+	EEPROMInfo    EEPROMInfo    `cmd name:"eeprom-info" help:"Show the contents of an EEPROM image."`
+	EEPROMRestore EEPROMRestore `cmd name:"eeprom-restore" help:"Write a backup to the EEPROM."`
+	EEPROMProbe   EEPROMProbe   `cmd name:"eeprom-probe" help:"Detect the EEPROM size and addressing without writing to it."`
+	USBIdentity   USBIdentity   `cmd name:"usb-id" help:"Show and edit the USB descriptors stored in the EEPROM."`
+	EDID          EDIDCmd       `cmd name:"edid" help:"Show and edit the HDMI EDID stored in the EEPROM."`
+
 	I2CScan     I2CScan     `cmd name:"i2c-scan" help:"Scan I2C bus and show discovered devices."`
 	I2CTransfer I2CTransfer `cmd name:"i2c-txfr" help:"Perform I2C transfer."`
+	I2CDump     I2CDump     `cmd name:"i2c-dump" help:"Dump the registers of an I2C device."`
+	I2CDiff     I2CDiff     `cmd name:"i2c-diff" help:"Compare the registers of an I2C device with a saved dump."`
+
+	SPITransfer SPITransfer `cmd name:"spi-txfr" help:"Perform SPI transfer on the GPIO pins."`
+	SPIFlash    SPIFlash    `cmd name:"spi-flash" help:"Identify, unprotect or erase a SPI flash on the GPIO pins."`
 
 	UARTTx UARTTx `cmd name:"uart-tx" help:"Transmit data over UART."`
 	FlirTX FlirTX `cmd name:"flir-tx" help:"Transmit FLIR Tau(2) command over UART."`
@@ -48,6 +85,67 @@ var CLI struct {
 	GPIOGet GPIOGet `cmd name:"gpio-get" help:"Get GPIO values."`
 }
 
+/* Commands that can work on files implement this to tell if the device is needed */
+type deviceOptional interface {
+	NeedDevice() bool
+}
+
+func needDevice(ctx *kong.Context) bool {
+	if ctx.Command() == "list-dev" {
+		return false
+	}
+
+	if cmd, ok := ctx.Selected().Target.Addr().Interface().(deviceOptional); ok {
+		return cmd.NeedDevice()
+	}
+	return true
+}
+
+func newHAL(dev gohid.HIDDevice, patch bool) (*mshal.HAL, error) {
+	config := mshal.HALConfig{
+		PatchTryInstall: patch,
+
+		PatchProbeEEPROM: true,
+		EEPromSize:       CLI.EEPROMSize,
+
+		EEPromPageSize:     CLI.EEPROMPageSize,
+		EEPromAddrBytes:    CLI.EEPROMAddrBits / 8,
+		EEPromWriteTimeout: CLI.EEPROMWriteTimeout,
+
+		I2CSpeed:          CLI.I2CSpeed,
+		I2CStretchTimeout: CLI.I2CStretchTimeout,
+
+		SPISpeed: CLI.SPISpeed,
+
+		PatchIgnoreUserFirmware: CLI.NoFirmware,
+
+		LogFunc: func(level int, format string, param ...interface{}) {
+			if level > CLI.LogLevel {
+				return
+			}
+			str := fmt.Sprintf(format, param...)
+			fmt.Printf("HAL(%d): %s\n", level, str)
+		},
+	}
+
+	if CLI.ROMDump != "" {
+		rom, err := os.ReadFile(CLI.ROMDump)
+		if err != nil {
+			return nil, err
+		}
+		config.PatchROMImage = rom
+	}
+
+	if len(CLI.SPIPins) > 0 {
+		if len(CLI.SPIPins) != 4 {
+			return nil, errors.New("Expected 4 SPI pins")
+		}
+		config.SPIPins = &mshal.SPIPins{SCK: CLI.SPIPins[0], MOSI: CLI.SPIPins[1], MISO: CLI.SPIPins[2], CS: CLI.SPIPins[3]}
+	}
+
+	return mshal.New(dev, config)
+}
+
 func main() {
 	k, err := kong.New(&CLI,
 		kong.NamedMapper("int", intMapper{}),
@@ -63,43 +161,35 @@ func main() {
 		return
 	}
 
+	/* --preflight-only is the command by itself */
+	if CLI.PreflightOnly != (ctx.Command() == "preflight") {
+		if CLI.PreflightOnly {
+			fmt.Println("--preflight-only can't be combined with a command")
+		} else {
+			fmt.Println("Expected a command, see --help")
+		}
+		return
+	}
+
 	c := &Context{}
-	if ctx.Command() != "list-dev" {
+	if needDevice(ctx) {
 		dev, err := OpenDevice()
 		if err != nil {
 			fmt.Println("Failed to open device", err)
 			return
 		}
-		defer dev.Close()
+		defer func() {
+			if c.dev != nil {
+				c.dev.Close()
+			}
+		}()
 
 		c.dev = dev
-		config := mshal.HALConfig{
-			PatchTryInstall: !CLI.NoPatch,
-
-			PatchProbeEEPROM: true,
-			EEPromSize:       CLI.EEPROMSize,
-
-			PatchIgnoreUserFirmware: CLI.NoFirmware,
-
-			LogFunc: func(level int, format string, param ...interface{}) {
-				if level > CLI.LogLevel {
-					return
-				}
-				str := fmt.Sprintf(format, param...)
-				fmt.Printf("HAL(%d): %s\n", level, str)
-			},
-		}
-
-		c.hal, err = mshal.New(dev, config)
+		c.hal, err = newHAL(dev, !CLI.NoPatch && !CLI.PreflightOnly)
 		if err != nil {
 			fmt.Println("Failed to create HAL", err)
 			return
 		}
-
-		// Initialize flash memory region
-		if wrapper, ok := dev.(*hidDeviceWrapper); ok {
-			c.flash = &FlashMemoryRegion{dev: wrapper}
-		}
 	}
 
 	err = ctx.Run(c)
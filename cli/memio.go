@@ -6,10 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/inancgumus/screen"
 	"github.com/johnneerdael/ms-tools/mshal"
+	"github.com/johnneerdael/ms-tools/mshal/spinor"
 )
 
 type MEMIOListRegions struct {
@@ -25,17 +28,49 @@ func (l *MEMIOListRegions) Run(c *Context) error {
 
 	for _, m := range regions {
 		parent, offset := mshal.RecursiveGetParentAddress(m, 0)
-		fmt.Printf("%-13s|      %5d |", m.GetName(), m.GetLength())
+		fmt.Printf("%-13s| %10d |", m.GetName(), m.GetLength())
 		if parent != m {
 			fmt.Printf(" %s.%04X", parent.GetName(), offset)
 		}
 		fmt.Printf("\n")
 	}
+	return nil
+}
 
-	if c.flash != nil {
-		fmt.Printf("%-13s|      %5d |\n", "FLASH", c.flash.GetLength())
+/* memoryRegionGet also accepts I2CEEPROM@ADDR:SIZE[:PAGESIZE[:ADDRBITS]] for EEPROMs on the I2C bus
+ * and SPIFLASH for a flash on the SPI pins */
+func memoryRegionGet(c *Context, name string) (mshal.MemoryRegion, error) {
+	if strings.EqualFold(name, string(mshal.MemoryRegionSPIFlash)) {
+		flash, err := spinor.New(c.hal)
+		if err != nil {
+			return nil, err
+		}
+		return flash.Region(), nil
 	}
-	return nil
+
+	prefix := string(mshal.MemoryRegionI2CEEPROM) + "@"
+	if !strings.HasPrefix(strings.ToUpper(name), prefix) {
+		return c.hal.MemoryRegionGet(mshal.MemoryRegionNameType(name)), nil
+	}
+
+	var param [4]int
+	fields := strings.Split(name[len(prefix):], ":")
+	if len(fields) < 2 || len(fields) > len(param) {
+		return nil, fmt.Errorf("Expected %sADDR:SIZE[:PAGESIZE[:ADDRBITS]]", prefix)
+	}
+	for i, m := range fields {
+		value, err := strconv.ParseInt(m, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		param[i] = int(value)
+	}
+
+	if param[3] != 0 && param[3] != 8 && param[3] != 16 {
+		return nil, errors.New("EEPROM address width must be 8 or 16 bits")
+	}
+
+	return c.hal.MemoryRegionI2CEEPROM(uint8(param[0]), param[1], param[3]/8, param[2])
 }
 
 type Region struct {
@@ -56,15 +91,9 @@ func (l *MEMIOReadCmd) Run(c *Context) error {
 		return errors.New("Loop flag out of range")
 	}
 
-	var region interface {
-		GetLength() int
-		Access(write bool, addr int, buf []byte) (int, error)
-	}
-
-	if l.Region.Region == "FLASH" && c.flash != nil {
-		region = c.flash
-	} else {
-		region = c.hal.MemoryRegionGet(mshal.MemoryRegionNameType(l.Region.Region))
+	region, err := memoryRegionGet(c, l.Region.Region)
+	if err != nil {
+		return err
 	}
 
 	if region == nil {
@@ -84,7 +113,13 @@ func (l *MEMIOReadCmd) Run(c *Context) error {
 		}
 
 		buf := make([]byte, l.Amount)
-		n, err := region.Access(false, l.Region.Addr, buf)
+		var n int
+		var err error
+		if l.Filename != "" {
+			n, err = readProgress(region, l.Region.Addr, buf)
+		} else {
+			n, err = region.Access(false, l.Region.Addr, buf)
+		}
 		if err != nil {
 			return fmt.Errorf("Read error: %s", err.Error())
 		}
@@ -130,22 +165,44 @@ func (l *MEMIOReadCmd) Run(c *Context) error {
 	return nil
 }
 
+/* readProgress reads in blocks and shows how fast it goes, as dumping a slow region like FLASH
+ * can take a while */
+func readProgress(region mshal.MemoryRegion, addr int, buf []byte) (int, error) {
+	const blockSize = 4096
+
+	start := time.Now()
+	total := 0
+	defer fmt.Println()
+
+	for total < len(buf) {
+		end := total + blockSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		n, err := region.Access(false, addr+total, buf[total:end])
+		total += n
+
+		rate := float64(total) / time.Since(start).Seconds()
+		fmt.Printf("\rRead %d of %d bytes, %.0f bytes/s", total, len(buf), rate)
+
+		if err != nil || n == 0 {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
 type MEMIOWriteCmd struct {
 	Zone  Region `embed`
 	Value int    `arg name:"value" help:"Value to write." type:"int"`
 }
 
 func (w MEMIOWriteCmd) Run(c *Context) error {
-	var region interface {
-		GetLength() int
-		Access(write bool, addr int, buf []byte) (int, error)
-		GetAlignment() int
-	}
-
-	if w.Zone.Region == "FLASH" && c.flash != nil {
-		region = c.flash
-	} else {
-		region = c.hal.MemoryRegionGet(mshal.MemoryRegionNameType(w.Zone.Region))
+	region, err := memoryRegionGet(c, w.Zone.Region)
+	if err != nil {
+		return err
 	}
 
 	if region == nil {
@@ -168,7 +225,7 @@ func (w MEMIOWriteCmd) Run(c *Context) error {
 
 	var value [1]byte
 	value[0] = byte(w.Value)
-	_, err := region.Access(true, w.Zone.Addr, value[:])
+	_, err = region.Access(true, w.Zone.Addr, value[:])
 	return err
 }
 
@@ -176,7 +233,8 @@ type MEMIOWriteFileCmd struct {
 	Region   Region `embed`
 	Filename string `arg name:"filename" help:"File to read data from."`
 
-	Verify bool `optional name:"verify" help:"Read and verify written file."`
+	Verify      bool `optional name:"verify" help:"Read and verify written file."`
+	ChangedOnly bool `optional name:"changed-only" help:"Read the region first and only write pages that differ."`
 }
 
 func (w MEMIOWriteFileCmd) Run(c *Context) error {
@@ -185,23 +243,40 @@ func (w MEMIOWriteFileCmd) Run(c *Context) error {
 		return err
 	}
 
-	var region interface {
-		GetLength() int
-		Access(write bool, addr int, buf []byte) (int, error)
-	}
-
-	if w.Region.Region == "FLASH" && c.flash != nil {
-		region = c.flash
-	} else {
-		region = c.hal.MemoryRegionGet(mshal.MemoryRegionNameType(w.Region.Region))
+	region, err := memoryRegionGet(c, w.Region.Region)
+	if err != nil {
+		return err
 	}
 
 	if region == nil {
 		return errors.New("Invalid memory region")
 	}
 
+	/* EEPROM writes are backed up, verified and rolled back on failure */
+	if region.GetName() == mshal.MemoryRegionEEPROM {
+		if w.Region.Addr < 0 || w.Region.Addr+len(data) > region.GetLength() {
+			return errors.New("File does not fit in EEPROM")
+		}
+
+		orig, _, err := eepromLoad(c, "")
+		if err != nil {
+			return err
+		}
+
+		image := append([]byte{}, orig...)
+		copy(image[w.Region.Addr:], data)
+		return eepromWriteChanged(c, orig, image)
+	}
+
+	var stats mshal.DiffWriteStats
+	if w.ChangedOnly {
+		region = mshal.RegionWrapDiffWrite(region, &stats)
+	}
+
 	n, err := region.Access(true, w.Region.Addr, data)
-	if n > 0 {
+	if w.ChangedOnly {
+		fmt.Printf("Wrote %d bytes to %s:%04x, skipped %d unchanged bytes.\n", stats.Written, w.Region.Region, w.Region.Addr, stats.Skipped)
+	} else if n > 0 {
 		fmt.Printf("Wrote %d bytes to %s:%04x.\n", n, w.Region.Region, w.Region.Addr)
 	}
 
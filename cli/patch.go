@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type PatchPersist struct {
+	Filename string `optional help:"Write the patched image to this file instead of the EEPROM."`
+}
+
+func (p *PatchPersist) Run(c *Context) error {
+	orig, _, err := eepromLoad(c, "")
+	if err != nil {
+		return err
+	}
+
+	image, err := c.hal.PatchBuildEEPROM(orig)
+	if err != nil {
+		return err
+	}
+
+	if p.Filename != "" {
+		return os.WriteFile(p.Filename, image, 0644)
+	}
+
+	if err := eepromWriteChanged(c, orig, image); err != nil {
+		return err
+	}
+
+	fmt.Println("Power cycle the device to boot the patched firmware.")
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+type PreflightCmd struct {
+}
+
+func (p *PreflightCmd) Run(c *Context) error {
+	report, err := c.hal.PatchPreflight()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(report)
+
+	if !report.OK() {
+		return errors.New("Firmware is not compatible with the patch")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/johnneerdael/ms-tools/mshal/spinor"
+)
+
+type SPITransfer struct {
+	Mode  int    `optional enum:"0,1,2,3" default:"0" help:"SPI mode, bit 0 is CPHA and bit 1 is CPOL."`
+	Write string `arg optional name:"data" help:"Hex string to write to device."`
+	Read  int    `optional help:"Number of bytes to read after the written data."`
+}
+
+func (l *SPITransfer) Run(c *Context) error {
+	wrBuf, err := hex.DecodeString(l.Write)
+	if err != nil {
+		return err
+	}
+
+	rdBuf, err := c.hal.SPITransfer(l.Mode, wrBuf, l.Read)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Received %d bytes:\n", len(rdBuf))
+	fmt.Println(hexdump(0, rdBuf, nil))
+	return nil
+}
+
+type SPIFlash struct {
+	Unprotect bool `optional help:"Clear the block protection bits of the status register."`
+	EraseChip bool `optional help:"Erase the whole flash."`
+}
+
+func (l *SPIFlash) Run(c *Context) error {
+	flash, err := spinor.New(c.hal)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Flash:       %s\n", flash)
+	for _, m := range flash.EraseTypes {
+		fmt.Printf("Erase:       %d bytes (command %02x)\n", m.Size, m.Opcode)
+	}
+
+	if l.Unprotect {
+		if err := flash.Unprotect(); err != nil {
+			return err
+		}
+	}
+
+	status, err := flash.Status()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Status:      %02x\n", status)
+
+	if l.EraseChip {
+		if err := flash.EraseChip(); err != nil {
+			return err
+		}
+		fmt.Println("Flash erased.")
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/johnneerdael/ms-tools/mshal/mseeprom"
+)
+
+type USBIdentity struct {
+	Filename string `optional help:"Edit this EEPROM image instead of the device EEPROM."`
+
+	SetVID          int    `optional name:"set-vid" type:"hex" help:"New USB Vendor ID."`
+	SetPID          int    `optional name:"set-pid" type:"hex" help:"New USB Product ID."`
+	SetVID2         int    `optional name:"set-vid2" type:"hex" help:"New USB Vendor ID of the second device descriptor, if the firmware has one."`
+	SetPID2         int    `optional name:"set-pid2" type:"hex" help:"New USB Product ID of the second device descriptor."`
+	SetManufacturer string `optional name:"set-manufacturer" help:"New manufacturer string, at most as long as the current one. Shorter strings are padded with spaces."`
+	SetProduct      string `optional name:"set-product" help:"New product string, at most as long as the current one. Shorter strings are padded with spaces."`
+	SetSerial       string `optional name:"set-serial" help:"New serial number string, at most as long as the string it replaces. Shorter strings are padded with spaces. Without a serial number a string no descriptor refers to is taken."`
+	SerialIndex     int    `optional name:"serial-index" help:"String to use for --set-serial when the firmware has no serial number, instead of one no descriptor refers to."`
+}
+
+func (u *USBIdentity) NeedDevice() bool {
+	return u.Filename == ""
+}
+
+func (u *USBIdentity) print(id *mseeprom.USBIdentity) {
+	if id.DeviceOffset >= 0 {
+		fmt.Printf("Device descriptor at %04x: VID=%04x PID=%04x bcdDevice=%04x\n", id.DeviceOffset, id.VID, id.PID, id.BCDDevice)
+	} else {
+		fmt.Println("Device descriptor not found")
+	}
+	for i, m := range id.Alternates {
+		fmt.Printf("Device descriptor %d at %04x: VID=%04x PID=%04x bcdDevice=%04x\n", i+2, m.Offset, m.VID, m.PID, m.BCDDevice)
+	}
+
+	names := map[int]string{
+		id.IManufacturer: "manufacturer",
+		id.IProduct:      "product",
+		id.ISerial:       "serial",
+	}
+	for _, m := range id.Strings {
+		fmt.Printf("String %d at %04x: %q %s\n", m.Index, m.Offset, m.Value, names[m.Index])
+	}
+
+	for _, m := range id.Interfaces {
+		fmt.Printf("Interface %d.%d at %04x: %s (subclass %02x)\n", m.Number, m.Alternate, m.Offset, m.ClassName(), m.SubClass)
+	}
+	for _, m := range id.Frames {
+		fmt.Printf("Frame at %04x: %s %dx%d\n", m.Offset, m.Format, m.Width, m.Height)
+	}
+}
+
+func (u *USBIdentity) Run(c *Context) error {
+	orig, eepromSize, err := eepromLoad(c, u.Filename)
+	if err != nil {
+		return err
+	}
+
+	img, err := mseeprom.Parse(orig, eepromSize)
+	if err != nil {
+		return err
+	}
+
+	data := append([]byte{}, orig...)
+	id := mseeprom.FindUSBIdentity(data)
+
+	if u.SetVID != 0 || u.SetPID != 0 {
+		vid, pid := id.VID, id.PID
+		if u.SetVID != 0 {
+			vid = uint16(u.SetVID)
+		}
+		if u.SetPID != 0 {
+			pid = uint16(u.SetPID)
+		}
+		if err := id.SetIDs(data, vid, pid); err != nil {
+			return err
+		}
+	}
+
+	if u.SetVID2 != 0 || u.SetPID2 != 0 {
+		if len(id.Alternates) == 0 {
+			return errors.New("Firmware has only one device descriptor")
+		}
+		vid, pid := id.Alternates[0].VID, id.Alternates[0].PID
+		if u.SetVID2 != 0 {
+			vid = uint16(u.SetVID2)
+		}
+		if u.SetPID2 != 0 {
+			pid = uint16(u.SetPID2)
+		}
+		if err := id.SetAlternateIDs(data, 0, vid, pid); err != nil {
+			return err
+		}
+	}
+
+	if u.SetSerial != "" && id.ISerial == 0 {
+		index, err := id.AssignSerial(data, u.SerialIndex)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Firmware has no serial number, using string %d for it.\n", index)
+	}
+
+	for _, m := range []struct {
+		index int
+		value string
+	}{
+		{id.IManufacturer, u.SetManufacturer},
+		{id.IProduct, u.SetProduct},
+		{id.ISerial, u.SetSerial},
+	} {
+		if m.value == "" {
+			continue
+		}
+		if err := id.SetString(data, m.index, m.value); err != nil {
+			return err
+		}
+	}
+
+	u.print(id)
+
+	img.FixChecksum(data)
+
+	if u.Filename != "" {
+		if bytes.Equal(orig, data) {
+			return nil
+		}
+		return os.WriteFile(u.Filename, data, 0644)
+	}
+	return eepromWriteChanged(c, orig, data)
+}
@@ -10,6 +10,7 @@ require (
 	github.com/karalabe/usb v0.0.2
 	github.com/sigurn/crc16 v0.0.0-20240131213347-83fcde1e29d1
 	golang.org/x/sys v0.28.0
+	periph.io/x/conn/v3 v3.7.0
 )
 
 require (
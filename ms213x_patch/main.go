@@ -1,17 +1,40 @@
 package main
 
 import (
-	"encoding/binary"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 
-	"github.com/BertoldVdb/ms-tools/mshal/ms213x"
+	"github.com/johnneerdael/ms-tools/mshal/codepatch"
+	"github.com/johnneerdael/ms-tools/mshal/ms213x"
+	"github.com/johnneerdael/ms-tools/mshal/mseeprom"
 )
 
+/* Data behind the firmware is read from fixed addresses, so the code can only grow into blank space.
+ * Images that end with the firmware can grow freely. */
+func growInto(trailer []byte, growth int) []byte {
+	if len(trailer) == 0 {
+		return nil
+	}
+	if growth > len(trailer) {
+		log.Fatalf("Patched code needs %d more bytes, only %d are left behind it", growth, len(trailer))
+	}
+	for i, m := range trailer[:growth] {
+		if m != 0xff {
+			log.Fatalf("Patched code would overwrite data %d bytes behind it", i)
+		}
+	}
+	return trailer[growth:]
+}
+
 func main() {
 	input := flag.String("input", "", "Input filename")
 	output := flag.String("output", "/tmp/modified.bin", "Output filename")
+	patch := flag.String("patch", "ms2130_hooks.json", "Patch descriptor")
+	codeOutput := flag.String("code-output", "", "Also write the patched code to this file")
+	eeprom := flag.Bool("eeprom", false, "Input is an EEPROM image with user code instead of an MS213x flash image")
+	dryRun := flag.Bool("dry-run", false, "Only show the changes, do not write anything")
 	flag.Parse()
 
 	in, err := os.ReadFile(*input)
@@ -19,28 +42,57 @@ func main() {
 		log.Fatalln("Failed to open file:", err)
 	}
 
-	if err := ms213x.CheckImage(in); err != nil {
-		log.Fatalln("Failed to parse image:", in)
+	desc, err := codepatch.Load(*patch)
+	if err != nil {
+		log.Fatalln("Failed to load patch:", err)
 	}
 
-	clen := binary.BigEndian.Uint16(in[2:])
-	code := in[0x30:]
-	code = code[:clen]
+	var out []byte
+	var result *codepatch.Result
+	if *eeprom {
+		img, err := mseeprom.Parse(in, len(in))
+		if err != nil {
+			log.Fatalln("Failed to parse image:", err)
+		}
 
-	code, err = patch(code)
-	if err != nil {
-		log.Fatalln("Failed to patch code:", err)
-	}
+		result, err = desc.Apply(img.Code, img.Chip.CodeAddr(), img.Chip.MaxPatchableCodeLen())
+		if err != nil {
+			log.Fatalln("Failed to patch code:", err)
+		}
+
+		img.Trailer = growInto(img.Trailer, len(result.Code)-len(img.Code))
+		img.Code = result.Code
+		out = img.Bytes()
+	} else {
+		img, err := ms213x.Parse(in)
+		if err != nil {
+			log.Fatalln("Failed to parse image:", err)
+		}
+		if err := img.Check(); err != nil {
+			log.Fatalln("Invalid image:", err)
+		}
+
+		result, err = desc.Apply(img.Code, 0, 0xffff)
+		if err != nil {
+			log.Fatalln("Failed to patch code:", err)
+		}
 
-	out := make([]byte, 0x30, 0x30+len(code)+4)
-	copy(out, in)
-	binary.BigEndian.PutUint16(out[2:], uint16(len(code)))
+		img.Trailer = growInto(img.Trailer, len(result.Code)-len(img.Code))
+		img.Code = result.Code
+		img.Fix()
+		out = img.Bytes()
+	}
 
-	out = append(out, code...)
-	out = binary.BigEndian.AppendUint32(out, 0)
-	ms213x.FixImage(out)
+	fmt.Print(result.Report())
+	if *dryRun {
+		return
+	}
 
-	os.WriteFile("/tmp/modcode.bin", code, 0644)
+	if *codeOutput != "" {
+		if err := os.WriteFile(*codeOutput, result.Code, 0644); err != nil {
+			log.Fatalln("Failed to write code:", err)
+		}
+	}
 
 	if err := os.WriteFile(*output, out, 0644); err != nil {
 		log.Fatalln("Failed to write output:", err)
@@ -11,3 +11,6 @@ as31 -Fbin code.asm
 as31 -Fbin i2cRead2109.asm
 as31 -Fbin i2cRead2107.asm
 as31 -Fbin uart_tx.asm
+as31 -Fbin i2c_txfr.asm
+as31 -Fbin i2c_soft.asm
+as31 -Fbin spi.asm
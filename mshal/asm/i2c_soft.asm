@@ -0,0 +1,100 @@
+; Bit-banged I2C master, used instead of the ROM I2C functions when a bus speed is configured
+;   +0: start
+;   +3: stop
+;   +6: write, byte in R7, returns the ACK in C
+;   +9: read, C set to not acknowledge, returns the byte in R7
+; The pins and delays below are placeholders, the HAL fills them in after installing the blob.
+; R0-R3 and A are used.
+
+.EQU SCL,     0x80
+.EQU SDA,     0x81
+.EQU DELAY0,  1
+.EQU DELAY1,  1
+.EQU STRETCH, 1
+
+    LJMP start
+    LJMP stop
+    LJMP write
+    LJMP read
+
+start:
+    LCALL sda_hi
+    LCALL scl_hi
+    LCALL sda_lo
+    LCALL delay
+    LJMP  scl_lo
+
+stop:
+    LCALL sda_lo
+    LCALL delay
+    LCALL scl_hi
+    LCALL sda_hi
+    LJMP  delay
+
+write:
+    MOV  A, R7
+    MOV  R2, #8
+wbit:
+    RLC  A         ;MSB first
+    MOV  SDA, C
+    LCALL scl_hi
+    LCALL scl_lo
+    DJNZ R2, wbit
+
+    LCALL sda_hi   ;Release SDA for the ACK
+    LCALL scl_hi
+    MOV  C, SDA
+    CPL  C         ;ACK is low
+    LJMP scl_lo
+
+read:
+    CLR  A
+    RLC  A
+    MOV  R3, A     ;Not acknowledge flag
+    MOV  R2, #8
+    LCALL sda_hi
+rbit:
+    LCALL scl_hi
+    MOV  C, SDA
+    RLC  A
+    LCALL scl_lo
+    DJNZ R2, rbit
+    MOV  R7, A
+
+    MOV  A, R3
+    RRC  A
+    MOV  SDA, C    ;ACK is low
+    LCALL scl_hi
+    LCALL scl_lo
+    LJMP sda_hi
+
+sda_hi:
+    SETB SDA
+    RET
+
+sda_lo:
+    CLR  SDA
+    RET
+
+scl_lo:
+    CLR  SCL
+    SJMP delay
+
+; Release SCL and wait until the device stops stretching the clock, or give up after the timeout
+scl_hi:
+    SETB SCL
+    MOV  R0, #0
+    MOV  R1, #STRETCH
+stretch:
+    JB   SCL, delay
+    DJNZ R0, stretch
+    DJNZ R1, stretch
+
+; Half a clock period
+delay:
+    MOV  R0, #DELAY0
+    MOV  R1, #DELAY1
+d1:
+    DJNZ R0, d1
+    DJNZ R1, d1
+    RET
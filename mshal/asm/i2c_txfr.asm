@@ -0,0 +1,181 @@
+; Performs a complete I2C transaction using the ROM I2C functions
+;   DPTR: buffer, write data followed by space for the read data
+;   R5:   I2C address (write)
+;   R6:   number of bytes to write
+;   R7:   number of bytes to read
+; On success C is set and A, R2-R7 hold the first bytes of the buffer (R2 first, A last).
+; On failure C is cleared and R7 holds the byte that was not acknowledged:
+;   1=address (write), 2+n=write data byte n, 0xFF=address (read)
+; Without bytes to write or read only the address is sent, like a quick write.
+; The stubs at the end are filled in for the chip when the blob is installed.
+;
+; Entry points:
+;   +0 transfer
+;   +2 load:  return the 7 bytes at DPTR like a successful transfer
+;   +4 store: write R5-R7 to DPTR, to fill the buffer 3 bytes per call
+
+.EQU S_START, 0
+.EQU S_STOP,  8
+.EQU S_WRITE, 16
+.EQU S_READ,  24
+
+    SJMP txfr
+    SJMP load
+
+store:
+    MOV  A, R5
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, R6
+    MOVX @DPTR, A
+    INC  DPTR
+    MOV  A, R7
+    MOVX @DPTR, A
+    RET
+
+txfr:
+    MOV  A, R7
+    MOV  R2, A     ;Read length
+    MOV  R3, A     ;Read counter
+    MOV  A, R5
+    MOV  R4, A     ;Address
+    MOV  R5, #1    ;Status if the next byte is not acknowledged
+
+    ;The address is sent for writing unless there are only bytes to read
+    MOV  A, R6
+    JNZ  write
+    MOV  A, R3
+    JNZ  read
+
+write:
+    MOV  B, #S_START
+    LCALL rom
+    MOV  A, R4
+    MOV  R7, A
+    MOV  B, #S_WRITE
+    LCALL rom
+    JNC  nack
+
+    MOV  A, R6
+    JZ   read
+
+wloop:
+    INC  R5
+    MOVX A, @DPTR
+    INC  DPTR
+    MOV  R7, A
+    MOV  B, #S_WRITE
+    LCALL rom
+    JNC  nack
+    DJNZ R6, wloop
+
+read:
+    MOV  A, R3
+    JZ   done
+
+    MOV  R5, #0xFF
+    MOV  B, #S_START
+    LCALL rom
+    MOV  A, R4
+    ORL  A, #1
+    MOV  R7, A
+    MOV  B, #S_WRITE
+    LCALL rom
+    JNC  nack
+
+rloop:
+    CLR  A
+    CJNE R3, #1, ack
+    INC  A         ;Do not acknowledge the last byte
+ack:
+    MOV  R7, A
+    MOV  B, #S_READ
+    LCALL rom
+    MOV  A, R7
+    MOVX @DPTR, A
+    INC  DPTR
+    DJNZ R3, rloop
+
+done:
+    MOV  R5, #0
+nack:
+    MOV  B, #S_STOP
+    LCALL rom
+    MOV  A, R5
+    JZ   ok
+    MOV  R7, A
+    CLR  C
+    RET
+
+ok:
+    CLR  C         ;Go back to the start of the read data
+    MOV  A, DPL
+    SUBB A, R2
+    MOV  DPL, A
+    MOV  A, DPH
+    SUBB A, #0
+    MOV  DPH, A
+
+load:
+    MOVX A, @DPTR
+    MOV  R2, A
+    INC  DPTR
+    MOVX A, @DPTR
+    MOV  R3, A
+    INC  DPTR
+    MOVX A, @DPTR
+    MOV  R4, A
+    INC  DPTR
+    MOVX A, @DPTR
+    MOV  R5, A
+    INC  DPTR
+    MOVX A, @DPTR
+    MOV  R6, A
+    INC  DPTR
+    MOVX A, @DPTR
+    MOV  R7, A
+    INC  DPTR
+    MOVX A, @DPTR
+    SETB C
+    RET
+
+; Calls stub B with the argument in R7, A and C like the callgate does. R2-R6 and DPTR are preserved.
+rom:
+    PUSH DPL
+    PUSH DPH
+    MOV  A, R2
+    PUSH ACC
+    MOV  A, R3
+    PUSH ACC
+    MOV  A, R4
+    PUSH ACC
+    MOV  A, R5
+    PUSH ACC
+    MOV  A, R6
+    PUSH ACC
+
+    MOV  DPTR, #stubs
+    MOV  A, R7
+    RRC  A
+    MOV  A, B
+    LCALL jump
+
+    POP  ACC
+    MOV  R6, A
+    POP  ACC
+    MOV  R5, A
+    POP  ACC
+    MOV  R4, A
+    POP  ACC
+    MOV  R3, A
+    POP  ACC
+    MOV  R2, A
+    POP  DPH
+    POP  DPL
+    RET
+
+jump:
+    JMP  @A+DPTR
+
+stubs:
+    .skip 32
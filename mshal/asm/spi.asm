@@ -0,0 +1,164 @@
+; Bit-banged SPI master on P2, using the same conventions as gpio.asm
+;   DPTR: parameters followed by the data, the data is replaced by the received bytes
+;         SCK mask, MOSI mask, MISO mask, CS mask, delay low, delay high
+;   R6:   number of bytes
+;   R7:   bit 0: CPHA, bit 1: CPOL, bit 2: assert CS first, bit 3: release CS at the end,
+;         bit 4: send 0xFF instead of the data
+
+.EQU DATA,   125
+.EQU DELAY0, 126
+.EQU DELAY1, 127
+.EQU CPHA,   0xE0
+.EQU CPOL,   0xE1
+.EQU CSON,   0xE2
+.EQU CSOFF,  0xE3
+.EQU FILL,   0xE4
+.EQU ACC0,   0xE0
+
+    PUSH DATA
+    PUSH DELAY0
+    PUSH DELAY1
+
+    MOVX A, @DPTR
+    MOV  R2, A     ;SCK
+    INC  DPTR
+    MOVX A, @DPTR
+    MOV  R3, A     ;MOSI
+    INC  DPTR
+    MOVX A, @DPTR
+    MOV  R4, A     ;MISO
+    INC  DPTR
+    MOVX A, @DPTR
+    MOV  R5, A     ;CS
+    INC  DPTR
+    MOVX A, @DPTR
+    MOV  DELAY0, A
+    INC  DPTR
+    MOVX A, @DPTR
+    MOV  DELAY1, A
+    INC  DPTR
+
+    MOV  A, R7     ;Clock idle level, set before SCK becomes an output
+    JB   CPOL, idlehi
+    MOV  A, R2
+    CPL  A
+    ANL  P2, A
+    SJMP idle
+idlehi:
+    MOV  A, R2
+    ORL  P2, A
+idle:
+
+    MOV  A, R7     ;A new transfer starts with CS released, others keep it asserted
+    JNB  CSON, outputs
+    MOV  A, R5
+    ORL  P2, A
+
+outputs:
+    MOV  A, R2     ;SCK, MOSI and CS are outputs
+    ORL  A, R3
+    ORL  A, R5
+    CPL  A
+    ANL  P3, A
+    MOV  A, R4     ;MISO is an input
+    ORL  P3, A
+
+    MOV  A, R7
+    JNB  CSON, bytes
+    MOV  A, R5
+    CPL  A
+    ANL  P2, A
+    LCALL delay
+
+bytes:
+    MOV  A, R6
+    JZ   end
+
+byte:
+    MOV  A, R7
+    JB   FILL, fill
+    MOVX A, @DPTR
+    SJMP load
+fill:
+    MOV  A, #0xFF
+load:
+    MOV  DATA, A
+    MOV  B, #8
+
+bit:
+    MOV  A, R7
+    JB   CPHA, phase1
+
+    LCALL out      ;CPHA=0: data is valid before the leading edge
+    LCALL delay
+    LCALL toggle
+    LCALL in
+    LCALL delay
+    LCALL toggle
+    SJMP next
+
+phase1:
+    LCALL toggle   ;CPHA=1: data changes on the leading edge
+    LCALL out
+    LCALL delay
+    LCALL toggle
+    LCALL in
+    LCALL delay
+
+next:
+    DJNZ B, bit
+
+    MOV  A, DATA
+    MOVX @DPTR, A
+    INC  DPTR
+    DJNZ R6, byte
+
+end:
+    MOV  A, R7
+    JNB  CSOFF, done
+    LCALL delay
+    MOV  A, R5
+    ORL  P2, A
+
+done:
+    POP  DELAY1
+    POP  DELAY0
+    POP  DATA
+    RET
+
+; Shift the MSB of DATA out on MOSI
+out:
+    MOV  A, DATA
+    RLC  A
+    MOV  DATA, A
+    MOV  A, R3
+    JC   outhi
+    CPL  A
+    ANL  P2, A
+    RET
+outhi:
+    ORL  P2, A
+    RET
+
+; Shift MISO into the LSB of DATA
+in:
+    MOV  A, P2
+    ANL  A, R4
+    ADD  A, #0xFF
+    MOV  A, DATA
+    MOV  ACC0, C
+    MOV  DATA, A
+    RET
+
+toggle:
+    MOV  A, R2
+    XRL  P2, A
+    RET
+
+delay:
+    MOV  R0, DELAY0
+    MOV  R1, DELAY1
+d1:
+    DJNZ R0, d1
+    DJNZ R1, d1
+    RET
@@ -0,0 +1,432 @@
+package codepatch
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	opLJMP  = 0x02
+	opLCALL = 0x12
+)
+
+/* Change is a modification of the code, Old is nil for inserted code */
+type Change struct {
+	Addr int
+	Old  []byte
+	New  []byte
+	What string
+}
+
+type Result struct {
+	Build   *Build
+	Code    []byte
+	Symbols map[string]int /* Addresses of the inserted code */
+	Changes []Change
+}
+
+type patcher struct {
+	code   []byte
+	base   int
+	maxLen int
+
+	build   *Build
+	symbols map[string]int
+	changes []Change
+}
+
+/* Match returns the first build that matches code loaded at base */
+func (d *Descriptor) Match(code []byte, base int) (*Build, error) {
+	hash := sha256.Sum256(code)
+	hashStr := hex.EncodeToString(hash[:])
+
+	for i := range d.Builds {
+		b := &d.Builds[i]
+		if b.SHA256 != "" && !strings.EqualFold(b.SHA256, hashStr) {
+			continue
+		}
+
+		p := &patcher{code: code, base: base, build: b}
+		ok := true
+		for _, s := range b.Signatures {
+			match, err := p.matches(s.At, s.Hex)
+			if err != nil {
+				return nil, fmt.Errorf("build %q: %w", b.Name, err)
+			}
+			if !match {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("code (sha256 %s) matches none of the builds of %q", hashStr, d.Name)
+}
+
+/* Apply patches a copy of code loaded at address base, the code may grow up to maxLen bytes */
+func (d *Descriptor) Apply(code []byte, base int, maxLen int) (*Result, error) {
+	build, err := d.Match(code, base)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &patcher{
+		code:    append([]byte{}, code...),
+		base:    base,
+		maxLen:  maxLen,
+		build:   build,
+		symbols: make(map[string]int),
+	}
+
+	for i, op := range d.Ops {
+		if err := p.apply(op); err != nil {
+			return nil, fmt.Errorf("op %d (%s): %w", i, op.Op, err)
+		}
+	}
+
+	return &Result{
+		Build:   build,
+		Code:    p.code,
+		Symbols: p.symbols,
+		Changes: p.changes,
+	}, nil
+}
+
+func (p *patcher) resolve(s string) (int, error) {
+	if addr, ok := p.symbols[s]; ok {
+		return addr, nil
+	}
+	if value, ok := p.build.Symbols[s]; ok {
+		s = value
+	}
+
+	addr, err := parseAddr(s)
+	if err != nil {
+		return 0, fmt.Errorf("unknown symbol or address %q", s)
+	}
+	return addr, nil
+}
+
+func (p *patcher) offset(addr int, length int) (int, error) {
+	offset := addr - p.base
+	if offset < 0 || offset+length > len(p.code) {
+		return 0, fmt.Errorf("address %04x is outside the code", addr)
+	}
+	return offset, nil
+}
+
+func (p *patcher) matches(at string, pattern string) (bool, error) {
+	addr, err := p.resolve(at)
+	if err != nil {
+		return false, err
+	}
+	tokens, err := parseHex(pattern)
+	if err != nil {
+		return false, err
+	}
+	offset, err := p.offset(addr, len(tokens))
+	if err != nil {
+		return false, err
+	}
+
+	for i, t := range tokens {
+		if t.symbol != "" {
+			return false, errors.New("patterns can't contain symbols")
+		}
+		if !t.wildcard && p.code[offset+i] != t.value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+/* expand turns a hex template into bytes, symbols become 16-bit addresses */
+func (p *patcher) expand(template string) ([]byte, error) {
+	tokens, err := parseHex(template)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []byte
+	for _, t := range tokens {
+		switch {
+		case t.wildcard:
+			return nil, errors.New("code can't contain wildcards")
+		case t.symbol != "":
+			addr, err := p.resolve(t.symbol)
+			if err != nil {
+				return nil, err
+			}
+			result = binary.BigEndian.AppendUint16(result, uint16(addr))
+		default:
+			result = append(result, t.value)
+		}
+	}
+	return result, nil
+}
+
+func (p *patcher) write(addr int, data []byte, what string) error {
+	offset, err := p.offset(addr, len(data))
+	if err != nil {
+		return err
+	}
+
+	p.changes = append(p.changes, Change{
+		Addr: addr,
+		Old:  append([]byte{}, p.code[offset:offset+len(data)]...),
+		New:  append([]byte{}, data...),
+		What: what,
+	})
+	copy(p.code[offset:], data)
+	return nil
+}
+
+func (p *patcher) insert(code []byte, what string) (int, error) {
+	if len(p.code)+len(code) > p.maxLen {
+		return 0, fmt.Errorf("code would grow to %d bytes, at most %d fit", len(p.code)+len(code), p.maxLen)
+	}
+
+	addr := p.base + len(p.code)
+	p.code = append(p.code, code...)
+	p.changes = append(p.changes, Change{
+		Addr: addr,
+		New:  append([]byte{}, code...),
+		What: what,
+	})
+	return addr, nil
+}
+
+func (p *patcher) apply(op Op) error {
+	var at int
+	if op.At != "" {
+		var err error
+		if at, err = p.resolve(op.At); err != nil {
+			return err
+		}
+	}
+
+	if op.Expect != "" {
+		match, err := p.matches(op.At, op.Expect)
+		if err != nil {
+			return err
+		}
+		if !match {
+			return fmt.Errorf("code at %04x does not match %q", at, op.Expect)
+		}
+	}
+
+	switch op.Op {
+	case "insert":
+		return p.opInsert(op)
+
+	case "detour":
+		return p.opDetour(at, op.To)
+
+	case "jump":
+		return p.opBranch(at, opLJMP, op.To)
+
+	case "call":
+		return p.opBranch(at, opLCALL, op.To)
+
+	case "word":
+		value, err := p.resolve(op.Value)
+		if err != nil {
+			return err
+		}
+		return p.write(at, binary.BigEndian.AppendUint16(nil, uint16(value)), "word "+op.Value)
+
+	case "jumptable":
+		return p.opJumptable(at, op.Set, op.Remove)
+	}
+
+	return fmt.Errorf("unknown operation %q", op.Op)
+}
+
+func (p *patcher) opInsert(op Op) error {
+	code := op.code
+	if op.Hex != "" {
+		var err error
+		if code, err = p.expand(op.Hex); err != nil {
+			return err
+		}
+	}
+	if len(code) == 0 {
+		return errors.New("no code to insert")
+	}
+
+	code = append([]byte{}, code...)
+	addr := p.base + len(p.code)
+	for _, m := range op.Relocate {
+		if m < 0 || m+2 > len(code) {
+			return fmt.Errorf("relocation at %d is outside the code", m)
+		}
+		binary.BigEndian.PutUint16(code[m:], binary.BigEndian.Uint16(code[m:])+uint16(addr))
+	}
+
+	if _, err := p.insert(code, "insert "+op.Name); err != nil {
+		return err
+	}
+	if op.Name != "" {
+		p.symbols[op.Name] = addr
+	}
+	return nil
+}
+
+/* opDetour makes the LCALL or LJMP at addr go through a trampoline that first calls dest */
+func (p *patcher) opDetour(addr int, dest string) error {
+	offset, err := p.offset(addr, 3)
+	if err != nil {
+		return err
+	}
+	if op := p.code[offset]; op != opLJMP && op != opLCALL {
+		return fmt.Errorf("instruction at %04x is not LJMP or LCALL", addr)
+	}
+
+	destAddr, err := p.resolve(dest)
+	if err != nil {
+		return err
+	}
+
+	trampoline := []byte{opLCALL, byte(destAddr >> 8), byte(destAddr), opLJMP, p.code[offset+1], p.code[offset+2]}
+	tAddr, err := p.insert(trampoline, "detour trampoline to "+dest)
+	if err != nil {
+		return err
+	}
+
+	return p.write(addr+1, []byte{byte(tAddr >> 8), byte(tAddr)}, "detour to "+dest)
+}
+
+func (p *patcher) opBranch(addr int, op byte, dest string) error {
+	destAddr, err := p.resolve(dest)
+	if err != nil {
+		return err
+	}
+
+	what := "jump to " + dest
+	if op == opLCALL {
+		what = "call " + dest
+	}
+	return p.write(addr, []byte{op, byte(destAddr >> 8), byte(destAddr)}, what)
+}
+
+type jumptableEntry struct {
+	Key     uint8
+	Address uint16
+}
+
+/* The switch tables of the compiler hold address and key triples, ended by a zero address and
+ * the default address */
+func (p *patcher) jumptableParse(addr int) ([]jumptableEntry, uint16, error) {
+	var results []jumptableEntry
+
+	lastKey := -1
+	for {
+		offset, err := p.offset(addr, 4)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		target := binary.BigEndian.Uint16(p.code[offset:])
+		if target == 0 {
+			return results, binary.BigEndian.Uint16(p.code[offset+2:]), nil
+		}
+
+		key := int(p.code[offset+2])
+		if key < lastKey {
+			return nil, 0, fmt.Errorf("jump table keys at %04x are not sorted", addr)
+		}
+		lastKey = key
+
+		results = append(results, jumptableEntry{Key: uint8(key), Address: target})
+		addr += 3
+	}
+}
+
+func (p *patcher) opJumptable(addr int, set map[string]string, remove []string) error {
+	table, dflt, err := p.jumptableParse(addr)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[uint8]uint16)
+	for _, m := range table {
+		entries[m.Key] = m.Address
+	}
+
+	for _, m := range remove {
+		key, err := parseAddr(m)
+		if err != nil || key > 0xff {
+			return fmt.Errorf("invalid key %q", m)
+		}
+		delete(entries, uint8(key))
+	}
+
+	for k, v := range set {
+		key, err := parseAddr(k)
+		if err != nil || key > 0xff {
+			return fmt.Errorf("invalid key %q", k)
+		}
+		target, err := p.resolve(v)
+		if err != nil {
+			return err
+		}
+		entries[uint8(key)] = uint16(target)
+	}
+
+	if len(entries) > len(table) {
+		return fmt.Errorf("jump table grows from %d to %d entries, it can't be moved", len(table), len(entries))
+	}
+
+	var newTable []jumptableEntry
+	for k, v := range entries {
+		newTable = append(newTable, jumptableEntry{Key: k, Address: v})
+	}
+	sort.Slice(newTable, func(i, j int) bool {
+		return newTable[i].Key < newTable[j].Key
+	})
+
+	var data []byte
+	for _, m := range newTable {
+		data = binary.BigEndian.AppendUint16(data, m.Address)
+		data = append(data, m.Key)
+	}
+	data = binary.BigEndian.AppendUint16(data, 0)
+	data = binary.BigEndian.AppendUint16(data, dflt)
+
+	return p.write(addr, data, "jump table")
+}
+
+/* Report lists the changes, for reviewing a patch without writing it */
+func (r *Result) Report() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "Build: %s\n", r.Build.Name)
+	for _, m := range r.Changes {
+		if m.Old == nil {
+			fmt.Fprintf(&sb, "%04x: inserted %d bytes (%s)\n", m.Addr, len(m.New), m.What)
+			continue
+		}
+		fmt.Fprintf(&sb, "%04x: %s -> %s (%s)\n", m.Addr, hex.EncodeToString(m.Old), hex.EncodeToString(m.New), m.What)
+	}
+
+	var names []string
+	for name := range r.Symbols {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return r.Symbols[names[i]] < r.Symbols[names[j]]
+	})
+	for _, name := range names {
+		fmt.Fprintf(&sb, "Symbol %s: %04x\n", name, r.Symbols[name])
+	}
+
+	return sb.String()
+}
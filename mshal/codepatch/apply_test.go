@@ -0,0 +1,151 @@
+package codepatch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+/* synthCode builds code with the instructions and jump table ms2130_hooks.json expects at the
+ * addresses of the supported build, everything else is filler */
+func synthCode() []byte {
+	code := make([]byte, 0xea00)
+	for i := range code {
+		code[i] = byte(i*31 + i>>8)
+	}
+	code[0x4d48] = opLCALL
+	code[0x4d70] = opLJMP
+	copy(code[0x1d9c:], []byte{
+		0x11, 0x22, 0x01, 0x11, 0x33, 0x80, 0x12, 0x00, 0xef, 0x44, 0x44, 0xf7,
+		0x55, 0x55, 0xfe, 0x66, 0x66, 0xff, 0x00, 0x00, 0x77, 0x77,
+	})
+	return code
+}
+
+func codeHash(code []byte) string {
+	hash := sha256.Sum256(code)
+	return hex.EncodeToString(hash[:])
+}
+
+/* loadHooks loads the MS2130 descriptor with its build matching the synthetic code */
+func loadHooks(t *testing.T, code []byte) *Descriptor {
+	d, err := Load("../../ms213x_patch/ms2130_hooks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Builds[0].SHA256 = codeHash(code)
+	return d
+}
+
+/* diff lists the changed and appended ranges, in the format of the golden file */
+func diff(in []byte, out []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(in); {
+		if out[i] == in[i] {
+			i++
+			continue
+		}
+		j := i
+		for j < len(in) && out[j] != in[j] {
+			j++
+		}
+		fmt.Fprintf(&sb, "%04x: %s\n", i, hex.EncodeToString(out[i:j]))
+		i = j
+	}
+	fmt.Fprintf(&sb, "%04x: %s\n", len(in), hex.EncodeToString(out[len(in):]))
+	return sb.String()
+}
+
+/* The golden file holds the output of the hard-coded patch that ms2130_hooks.json replaced */
+func TestApplyMS2130Hooks(t *testing.T) {
+	golden, err := os.ReadFile("testdata/ms2130_hooks.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := synthCode()
+	result, err := loadHooks(t, code).Apply(code, 0, 0xffff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := diff(code, result.Code); got != string(golden) {
+		t.Errorf("patched code differs from the hard-coded patch:\n%s\nexpected:\n%s", got, golden)
+	}
+	if codeHash(code) != codeHash(synthCode()) {
+		t.Error("Apply modified its input")
+	}
+
+	for name, addr := range map[string]int{"init": 0xea00, "hook": 0xea1c, "readinfo": 0xeaac, "readinfo2": 0xeac4} {
+		if result.Symbols[name] != addr {
+			t.Errorf("symbol %s is %04x, expected %04x", name, result.Symbols[name], addr)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	code := synthCode()
+	hooks := loadHooks(t, code)
+
+	tests := []struct {
+		name   string
+		desc   *Descriptor
+		maxLen int
+		err    string
+	}{
+		{
+			name: "unknown build",
+			desc: &Descriptor{
+				Builds: []Build{{Name: "other", SHA256: strings.Repeat("00", 32)}},
+			},
+			maxLen: 0xffff,
+			err:    "matches none of the builds",
+		},
+		{
+			name: "expect mismatch",
+			desc: &Descriptor{
+				Builds: hooks.Builds,
+				Ops:    []Op{{Op: "jump", At: "f660Finish", Expect: "02 ?? ??", To: "0x1234"}},
+			},
+			maxLen: 0xffff,
+			err:    "does not match",
+		},
+		{
+			name: "jump table grows",
+			desc: &Descriptor{
+				Builds: hooks.Builds,
+				Ops:    []Op{{Op: "jumptable", At: "usbCommandTable", Set: map[string]string{"0xee": "0x1234"}}},
+			},
+			maxLen: 0xffff,
+			err:    "jump table grows from 6 to 7 entries",
+		},
+		{
+			name:   "maxLen exceeded",
+			desc:   hooks,
+			maxLen: len(code) + 0x20,
+			err:    "code would grow",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.desc.Apply(code, 0, tc.maxLen)
+			if err == nil {
+				t.Fatalf("expected an error containing %q", tc.err)
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("error %q does not contain %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestParseExpectWithoutAt(t *testing.T) {
+	_, err := Parse([]byte(`{"builds": [{"name": "any", "sha256": "00"}], "ops": [{"op": "insert", "hex": "22", "expect": "22"}]}`), nil)
+	if err == nil || !strings.Contains(err.Error(), "expect needs at") {
+		t.Fatalf("expected an error for expect without at, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+/* Package codepatch applies binary patches described in a JSON file to 8051 code, such as the
+ * MS2130 firmware in flash or the user code stored in an EEPROM. A descriptor lists the builds
+ * it can be applied to, each with its own addresses, and the operations to perform. */
+package codepatch
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type Descriptor struct {
+	Name   string  `json:"name"`
+	Builds []Build `json:"builds"`
+	Ops    []Op    `json:"ops"`
+}
+
+/* Build matches the code by hash, signatures or both. Symbols hold the addresses the operations
+ * use that differ between builds. */
+type Build struct {
+	Name       string            `json:"name"`
+	SHA256     string            `json:"sha256,omitempty"`
+	Signatures []Signature       `json:"signatures,omitempty"`
+	Symbols    map[string]string `json:"symbols,omitempty"`
+}
+
+/* Signature is a hex pattern expected at an address, "??" matches any byte */
+type Signature struct {
+	At  string `json:"at"`
+	Hex string `json:"hex"`
+}
+
+/* Op is a single patch operation:
+ *   insert     append code from Asm (the .bin as31 makes from it) or Hex, defining Name as its
+ *              address. Relocate lists offsets of 16-bit addresses in the code that are relative
+ *              to its start. Hex can refer to addresses with {symbol}.
+ *   detour     replace the LCALL/LJMP at At by a call to To followed by the original target
+ *   jump, call replace the instruction at At by an LJMP/LCALL to To
+ *   word       write the 16-bit Value at At, eg. to relocate the address of a variable
+ *   jumptable  edit the switch table at At: Set adds or replaces keys, Remove deletes them
+ * Expect optionally gives the bytes that must be at At before the operation. */
+type Op struct {
+	Op   string `json:"op"`
+	Name string `json:"name,omitempty"`
+
+	At     string `json:"at,omitempty"`
+	Expect string `json:"expect,omitempty"`
+
+	Asm      string `json:"asm,omitempty"`
+	Hex      string `json:"hex,omitempty"`
+	Relocate []int  `json:"relocate,omitempty"`
+
+	To    string `json:"to,omitempty"`
+	Value string `json:"value,omitempty"`
+
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+
+	code []byte
+}
+
+/* Load reads a descriptor, assembler sources are looked up relative to it */
+func Load(filename string) (*Descriptor, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, os.DirFS(filepath.Dir(filename)))
+}
+
+/* Parse decodes a descriptor and loads the binaries of the assembler sources from fsys */
+func Parse(data []byte, fsys fs.FS) (*Descriptor, error) {
+	var d Descriptor
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+
+	if len(d.Builds) == 0 {
+		return nil, errors.New("descriptor lists no builds")
+	}
+	for _, b := range d.Builds {
+		if b.SHA256 == "" && len(b.Signatures) == 0 {
+			return nil, fmt.Errorf("build %q has no hash or signature", b.Name)
+		}
+	}
+
+	for i := range d.Ops {
+		op := &d.Ops[i]
+		if op.Expect != "" && op.At == "" {
+			return nil, fmt.Errorf("op %d: expect needs at, the address of the bytes to check", i)
+		}
+		if op.Op != "insert" || op.Asm == "" {
+			continue
+		}
+
+		bin := strings.TrimSuffix(op.Asm, path.Ext(op.Asm)) + ".bin"
+		code, err := fs.ReadFile(fsys, bin)
+		if err != nil {
+			return nil, fmt.Errorf("op %d: %w, assemble %s first", i, err, op.Asm)
+		}
+		op.code = code
+	}
+
+	return &d, nil
+}
+
+/* hexToken is a byte, a wildcard or a symbol in a hex pattern */
+type hexToken struct {
+	value    byte
+	wildcard bool
+	symbol   string
+}
+
+func parseHex(s string) ([]hexToken, error) {
+	var result []hexToken
+
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == ' ' || s[i] == '\t':
+			i++
+
+		case s[i] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated symbol in %q", s)
+			}
+			result = append(result, hexToken{symbol: s[i+1 : i+end]})
+			i += end + 1
+
+		case i+2 > len(s):
+			return nil, fmt.Errorf("odd number of digits in %q", s)
+
+		case s[i:i+2] == "??":
+			result = append(result, hexToken{wildcard: true})
+			i += 2
+
+		default:
+			b, err := hex.DecodeString(s[i : i+2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid hex in %q: %w", s, err)
+			}
+			result = append(result, hexToken{value: b[0]})
+			i += 2
+		}
+	}
+
+	return result, nil
+}
+
+func parseAddr(s string) (int, error) {
+	v, err := strconv.ParseUint(s, 0, 16)
+	return int(v), err
+}
@@ -0,0 +1,220 @@
+package edid
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	TagAudio    = 1
+	TagVideo    = 2
+	TagVendor   = 3
+	TagSpeaker  = 4
+	TagExtended = 7
+
+	ExtTagVideo420  = 0x0e
+	ExtTagCapMap420 = 0x0f
+)
+
+type DataBlock struct {
+	Tag  byte
+	Data []byte
+}
+
+func (b DataBlock) ExtTag() int {
+	if b.Tag != TagExtended || len(b.Data) == 0 {
+		return -1
+	}
+	return int(b.Data[0])
+}
+
+func (b DataBlock) IsHDMI() bool {
+	return b.Tag == TagVendor && len(b.Data) >= 5 && b.Data[0] == 0x03 && b.Data[1] == 0x0c && b.Data[2] == 0x00
+}
+
+type CTA struct {
+	Revision byte
+	Flags    byte
+
+	Blocks []DataBlock
+	DTDs   []DetailedTiming
+}
+
+func ParseCTA(f []byte) (*CTA, error) {
+	if len(f) < BlockLen || f[0] != 0x02 {
+		return nil, errors.New("not a CTA-861 extension")
+	}
+
+	c := &CTA{
+		Revision: f[1],
+		Flags:    f[3],
+	}
+
+	d := int(f[2])
+	if d == 0 {
+		return c, nil
+	}
+	if d < 4 || d > BlockLen-1 {
+		return nil, fmt.Errorf("invalid DTD offset: %d", d)
+	}
+
+	for offset := 4; offset < d; {
+		l := int(f[offset] & 0x1f)
+		if offset+1+l > d {
+			return nil, fmt.Errorf("data block at %d exceeds data block collection", offset)
+		}
+
+		c.Blocks = append(c.Blocks, DataBlock{
+			Tag:  f[offset] >> 5,
+			Data: append([]byte{}, f[offset+1:offset+1+l]...),
+		})
+		offset += 1 + l
+	}
+
+	for offset := d; offset+18 <= BlockLen-1; offset += 18 {
+		if !isDetailedTiming(f[offset:]) {
+			break
+		}
+		c.DTDs = append(c.DTDs, ParseDetailedTiming(f[offset:]))
+	}
+
+	return c, nil
+}
+
+/* Bytes encodes the extension, the checksum is filled in by EDID.Bytes */
+func (c *CTA) Bytes() ([]byte, error) {
+	out := []byte{0x02, c.Revision, 0, c.Flags}
+
+	for _, m := range c.Blocks {
+		if len(m.Data) > 0x1f {
+			return nil, fmt.Errorf("data block with tag %d is too long", m.Tag)
+		}
+		out = append(out, m.Tag<<5|byte(len(m.Data)))
+		out = append(out, m.Data...)
+	}
+	out[2] = byte(len(out))
+
+	for _, m := range c.DTDs {
+		out = append(out, m.Bytes()...)
+	}
+
+	if len(out) > BlockLen-1 {
+		return nil, errors.New("CTA extension does not fit in one block")
+	}
+
+	return append(out, make([]byte, BlockLen-len(out))...), nil
+}
+
+type SVD struct {
+	VIC    int
+	Native bool
+}
+
+func decodeSVD(b byte) SVD {
+	if b >= 129 && b <= 192 {
+		return SVD{VIC: int(b & 0x7f), Native: true}
+	}
+	return SVD{VIC: int(b)}
+}
+
+/* VICs returns the video formats of all video data blocks */
+func (c *CTA) VICs() []SVD {
+	var result []SVD
+	for _, m := range c.Blocks {
+		if m.Tag == TagVideo {
+			for _, v := range m.Data {
+				result = append(result, decodeSVD(v))
+			}
+		}
+	}
+	return result
+}
+
+type SAD struct {
+	Format   int
+	Channels int
+	Rates    byte
+	Extra    byte
+}
+
+var audioFormats = []string{"", "LPCM", "AC-3", "MPEG-1", "MP3", "MPEG-2", "AAC LC", "DTS", "ATRAC", "DSD", "E-AC-3", "DTS-HD", "MLP", "DST", "WMA Pro", "Extended"}
+
+var audioRates = []string{"32", "44.1", "48", "88.2", "96", "176.4", "192"}
+
+func (s SAD) String() string {
+	var rates []string
+	for i, m := range audioRates {
+		if s.Rates&(1<<i) > 0 {
+			rates = append(rates, m)
+		}
+	}
+
+	result := fmt.Sprintf("%s, %d channels, %s kHz", audioFormats[s.Format&0xf], s.Channels, strings.Join(rates, "/"))
+	if s.Format == 1 {
+		var bits []string
+		for i, m := range []string{"16", "20", "24"} {
+			if s.Extra&(1<<i) > 0 {
+				bits = append(bits, m)
+			}
+		}
+		result += fmt.Sprintf(", %s bit", strings.Join(bits, "/"))
+	}
+	return result
+}
+
+/* SADs returns the audio formats of all audio data blocks */
+func (c *CTA) SADs() []SAD {
+	var result []SAD
+	for _, m := range c.Blocks {
+		if m.Tag != TagAudio {
+			continue
+		}
+		for i := 0; i+3 <= len(m.Data); i += 3 {
+			result = append(result, SAD{
+				Format:   int(m.Data[i]>>3) & 0xf,
+				Channels: int(m.Data[i]&7) + 1,
+				Rates:    m.Data[i+1] & 0x7f,
+				Extra:    m.Data[i+2],
+			})
+		}
+	}
+	return result
+}
+
+/* hdmiVICOffset returns the location of the HDMI_VIC list in an HDMI vendor block, or -1 */
+func hdmiVICOffset(b DataBlock) (int, int) {
+	if !b.IsHDMI() || len(b.Data) < 8 {
+		return -1, 0
+	}
+
+	offset := 8
+	if b.Data[7]&0x80 > 0 {
+		offset += 2
+	}
+	if b.Data[7]&0x40 > 0 {
+		offset += 2
+	}
+	if b.Data[7]&0x20 == 0 || offset+2 > len(b.Data) {
+		return -1, 0
+	}
+
+	vicLen := int(b.Data[offset+1] >> 5)
+	if offset+2+vicLen > len(b.Data) {
+		return -1, 0
+	}
+	return offset + 2, vicLen
+}
+
+/* HDMIVICs returns the extended resolutions from the HDMI vendor block */
+func (c *CTA) HDMIVICs() []int {
+	var result []int
+	for _, m := range c.Blocks {
+		if offset, l := hdmiVICOffset(m); offset >= 0 {
+			for _, v := range m.Data[offset : offset+l] {
+				result = append(result, int(v))
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,218 @@
+package edid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const BlockLen = 128
+
+var header = []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}
+
+type EDID struct {
+	Base       []byte
+	Extensions [][]byte
+}
+
+func checksum(block []byte) byte {
+	var sum byte
+	for _, m := range block[:BlockLen-1] {
+		sum += m
+	}
+	return -sum
+}
+
+func checksumValid(block []byte) bool {
+	return checksum(block) == block[BlockLen-1]
+}
+
+/* Parse decodes an EDID base block and the extensions following it */
+func Parse(f []byte) (*EDID, error) {
+	if len(f) < BlockLen {
+		return nil, errors.New("file too short (base block)")
+	}
+	if !bytes.Equal(f[:8], header) {
+		return nil, errors.New("EDID header not found")
+	}
+	if !checksumValid(f) {
+		return nil, errors.New("base block checksum mismatch")
+	}
+
+	e := &EDID{
+		Base: append([]byte{}, f[:BlockLen]...),
+	}
+
+	for i := 1; i <= int(f[126]); i++ {
+		if len(f) < (i+1)*BlockLen {
+			return nil, fmt.Errorf("file too short (extension %d)", i)
+		}
+		block := f[i*BlockLen : (i+1)*BlockLen]
+		if !checksumValid(block) {
+			return nil, fmt.Errorf("extension %d checksum mismatch", i)
+		}
+		e.Extensions = append(e.Extensions, append([]byte{}, block...))
+	}
+
+	return e, nil
+}
+
+/* Find returns the offset of the first valid EDID in f */
+func Find(f []byte) (int, error) {
+	offset := 0
+	for {
+		i := bytes.Index(f[offset:], header)
+		if i < 0 {
+			return 0, errors.New("no EDID found")
+		}
+		offset += i
+
+		if _, err := Parse(f[offset:]); err == nil {
+			return offset, nil
+		}
+		offset++
+	}
+}
+
+/* Len returns the size of the EDID in bytes */
+func (e *EDID) Len() int {
+	return BlockLen * (1 + len(e.Extensions))
+}
+
+/* Bytes encodes the EDID, updating the extension count and checksums */
+func (e *EDID) Bytes() []byte {
+	e.Base[126] = byte(len(e.Extensions))
+
+	out := make([]byte, 0, e.Len())
+	for _, m := range append([][]byte{e.Base}, e.Extensions...) {
+		m[BlockLen-1] = checksum(m)
+		out = append(out, m...)
+	}
+	return out
+}
+
+func (e *EDID) Manufacturer() string {
+	id := binary.BigEndian.Uint16(e.Base[8:])
+	return string([]byte{
+		byte('@' + (id>>10)&0x1f),
+		byte('@' + (id>>5)&0x1f),
+		byte('@' + id&0x1f),
+	})
+}
+
+func (e *EDID) ProductCode() uint16 {
+	return binary.LittleEndian.Uint16(e.Base[10:])
+}
+
+func (e *EDID) Serial() uint32 {
+	return binary.LittleEndian.Uint32(e.Base[12:])
+}
+
+func (e *EDID) Year() int {
+	return 1990 + int(e.Base[17])
+}
+
+func (e *EDID) Version() string {
+	return fmt.Sprintf("%d.%d", e.Base[18], e.Base[19])
+}
+
+/* Descriptors returns the four 18 byte descriptors of the base block */
+func (e *EDID) Descriptors() [][]byte {
+	var result [][]byte
+	for i := 0; i < 4; i++ {
+		result = append(result, e.Base[54+18*i:72+18*i])
+	}
+	return result
+}
+
+func descriptorText(d []byte) string {
+	text := string(d[5:18])
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimRight(text, " ")
+}
+
+/* Name returns the monitor name from the 0xFC descriptor */
+func (e *EDID) Name() string {
+	for _, d := range e.Descriptors() {
+		if !isDetailedTiming(d) && d[3] == 0xfc {
+			return descriptorText(d)
+		}
+	}
+	return ""
+}
+
+type StandardTiming struct {
+	Width   int
+	Height  int
+	Refresh int
+}
+
+func (e *EDID) StandardTimings() []StandardTiming {
+	var result []StandardTiming
+	for i := 38; i < 54; i += 2 {
+		if st, ok := decodeStandardTiming(e.Base[i:], e.Base[18] == 1 && e.Base[19] < 3); ok {
+			result = append(result, st)
+		}
+	}
+	return result
+}
+
+func decodeStandardTiming(b []byte, oldAspect bool) (StandardTiming, bool) {
+	if (b[0] == 0x01 && b[1] == 0x01) || b[0] == 0 {
+		return StandardTiming{}, false
+	}
+
+	width := (int(b[0]) + 31) * 8
+	var height int
+	switch b[1] >> 6 {
+	case 0:
+		if oldAspect {
+			height = width
+		} else {
+			height = width * 10 / 16
+		}
+	case 1:
+		height = width * 3 / 4
+	case 2:
+		height = width * 4 / 5
+	case 3:
+		height = width * 9 / 16
+	}
+
+	return StandardTiming{
+		Width:   width,
+		Height:  height,
+		Refresh: int(b[1]&0x3f) + 60,
+	}, true
+}
+
+/* DetailedTimings returns all detailed timings from the base block and CTA extensions */
+func (e *EDID) DetailedTimings() []DetailedTiming {
+	var result []DetailedTiming
+	for _, d := range e.Descriptors() {
+		if isDetailedTiming(d) {
+			result = append(result, ParseDetailedTiming(d))
+		}
+	}
+
+	for _, m := range e.Extensions {
+		if cta, err := ParseCTA(m); err == nil {
+			result = append(result, cta.DTDs...)
+		}
+	}
+	return result
+}
+
+/* CTA returns the first CTA-861 extension and its index */
+func (e *EDID) CTA() (*CTA, int) {
+	for i, m := range e.Extensions {
+		if cta, err := ParseCTA(m); err == nil {
+			return cta, i
+		}
+	}
+	return nil, -1
+}
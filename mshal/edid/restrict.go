@@ -0,0 +1,205 @@
+package edid
+
+import (
+	"errors"
+	"fmt"
+)
+
+/* Limit describes the modes a sink can handle, zero values mean no limit */
+type Limit struct {
+	MaxWidth   int
+	MaxHeight  int
+	MaxRefresh float64
+}
+
+func (l Limit) Allows(width int, height int, refresh float64) bool {
+	if l.MaxWidth > 0 && width > l.MaxWidth {
+		return false
+	}
+	if l.MaxHeight > 0 && height > l.MaxHeight {
+		return false
+	}
+	/* Allow for rounding, 59.94 and 60 are the same mode */
+	if l.MaxRefresh > 0 && refresh > l.MaxRefresh+0.5 {
+		return false
+	}
+	return true
+}
+
+func (l Limit) allowsFormat(f VideoFormat) bool {
+	return l.Allows(f.Width, f.Height, float64(f.Refresh))
+}
+
+func (l Limit) allowsTiming(t DetailedTiming) bool {
+	return l.Allows(t.HActive, t.Height(), t.Refresh())
+}
+
+var dummyDescriptor = []byte{0, 0, 0, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+/* Restrict removes all modes that exceed the limit and returns a description of the changes */
+func (e *EDID) Restrict(l Limit) ([]string, error) {
+	var changes []string
+
+	cta, ctaIndex := e.CTA()
+
+	/* Detailed timings in the base block, the first one is the preferred mode */
+	for i, d := range e.Descriptors() {
+		if !isDetailedTiming(d) {
+			continue
+		}
+
+		t := ParseDetailedTiming(d)
+		if l.allowsTiming(t) {
+			continue
+		}
+
+		if i > 0 {
+			copy(d, dummyDescriptor)
+			changes = append(changes, fmt.Sprintf("Removed detailed timing %s", t))
+			continue
+		}
+
+		replacement, from, err := e.preferredReplacement(l, cta)
+		if err != nil {
+			return nil, err
+		}
+		copy(d, replacement.Bytes())
+
+		/* Move rather than duplicate a timing from the base block */
+		if from > 0 {
+			copy(e.Descriptors()[from], dummyDescriptor)
+		}
+		changes = append(changes, fmt.Sprintf("Replaced preferred timing %s with %s", t, replacement))
+	}
+
+	/* Standard timings */
+	for i := 38; i < 54; i += 2 {
+		st, ok := decodeStandardTiming(e.Base[i:], e.Base[18] == 1 && e.Base[19] < 3)
+		if ok && !l.Allows(st.Width, st.Height, float64(st.Refresh)) {
+			e.Base[i] = 0x01
+			e.Base[i+1] = 0x01
+			changes = append(changes, fmt.Sprintf("Removed standard timing %dx%d@%d", st.Width, st.Height, st.Refresh))
+		}
+	}
+
+	if cta == nil {
+		return changes, nil
+	}
+
+	changes = append(changes, cta.restrict(l)...)
+
+	ext, err := cta.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	e.Extensions[ctaIndex] = ext
+
+	return changes, nil
+}
+
+/* preferredReplacement returns a timing within the limit and the base block descriptor it came from, if any */
+func (e *EDID) preferredReplacement(l Limit, cta *CTA) (DetailedTiming, int, error) {
+	for i, d := range e.Descriptors() {
+		if i > 0 && isDetailedTiming(d) {
+			if t := ParseDetailedTiming(d); l.allowsTiming(t) {
+				return t, i, nil
+			}
+		}
+	}
+
+	if cta != nil {
+		for _, t := range cta.DTDs {
+			if l.allowsTiming(t) {
+				return t, -1, nil
+			}
+		}
+	}
+
+	for _, t := range []DetailedTiming{Timing1080p60, Timing720p60} {
+		if l.allowsTiming(t) {
+			return t, -1, nil
+		}
+	}
+
+	return DetailedTiming{}, -1, errors.New("no timing within limit to use as preferred timing")
+}
+
+func (c *CTA) restrict(l Limit) []string {
+	var changes []string
+	var blocks []DataBlock
+	removedSVD := false
+
+	for _, m := range c.Blocks {
+		isVideo := m.Tag == TagVideo
+		is420 := m.ExtTag() == ExtTagVideo420
+
+		if isVideo || is420 {
+			start := 0
+			if is420 {
+				start = 1
+			}
+
+			data := append([]byte{}, m.Data[:start]...)
+			for _, v := range m.Data[start:] {
+				svd := decodeSVD(v)
+				if f, ok := VICFormat(svd.VIC); ok && !l.allowsFormat(f) {
+					changes = append(changes, fmt.Sprintf("Removed VIC %d (%s)", svd.VIC, f))
+					removedSVD = true
+					continue
+				}
+				data = append(data, v)
+			}
+
+			if len(data) == start {
+				continue
+			}
+			m.Data = data
+		} else if offset, vicLen := hdmiVICOffset(m); offset >= 0 {
+			var vics []byte
+			for _, v := range m.Data[offset : offset+vicLen] {
+				if f, ok := HDMIVICFormat(int(v)); ok && !l.allowsFormat(f) {
+					changes = append(changes, fmt.Sprintf("Removed HDMI VIC %d (%s)", v, f))
+					continue
+				}
+				vics = append(vics, v)
+			}
+
+			data := append([]byte{}, m.Data[:offset]...)
+			data[offset-1] = data[offset-1]&0x1f | byte(len(vics))<<5
+			data = append(data, vics...)
+			m.Data = append(data, m.Data[offset+vicLen:]...)
+		}
+
+		blocks = append(blocks, m)
+	}
+
+	/* The 4:2:0 capability map refers to SVDs by index, which are no longer valid */
+	if removedSVD {
+		c.Blocks = nil
+		for _, m := range blocks {
+			if m.ExtTag() == ExtTagCapMap420 {
+				changes = append(changes, "Removed YCbCr 4:2:0 capability map")
+				continue
+			}
+			c.Blocks = append(c.Blocks, m)
+		}
+	} else {
+		c.Blocks = blocks
+	}
+
+	var dtds []DetailedTiming
+	for _, t := range c.DTDs {
+		if !l.allowsTiming(t) {
+			changes = append(changes, fmt.Sprintf("Removed detailed timing %s", t))
+			continue
+		}
+		dtds = append(dtds, t)
+	}
+	c.DTDs = dtds
+
+	if native := int(c.Flags & 0xf); native > len(c.DTDs) {
+		c.Flags = c.Flags&0xf0 | byte(len(c.DTDs))
+	}
+
+	return changes
+}
@@ -0,0 +1,110 @@
+package edid
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type DetailedTiming struct {
+	PixelClock int /* kHz */
+
+	HActive     int
+	HBlank      int
+	HSyncOffset int
+	HSyncWidth  int
+	VActive     int
+	VBlank      int
+	VSyncOffset int
+	VSyncWidth  int
+
+	WidthMM  int
+	HeightMM int
+	HBorder  int
+	VBorder  int
+	Flags    byte
+}
+
+func isDetailedTiming(d []byte) bool {
+	return d[0] != 0 || d[1] != 0
+}
+
+func ParseDetailedTiming(d []byte) DetailedTiming {
+	return DetailedTiming{
+		PixelClock:  int(binary.LittleEndian.Uint16(d)) * 10,
+		HActive:     int(d[2]) | int(d[4]>>4)<<8,
+		HBlank:      int(d[3]) | int(d[4]&0xf)<<8,
+		VActive:     int(d[5]) | int(d[7]>>4)<<8,
+		VBlank:      int(d[6]) | int(d[7]&0xf)<<8,
+		HSyncOffset: int(d[8]) | int(d[11]>>6)<<8,
+		HSyncWidth:  int(d[9]) | int((d[11]>>4)&3)<<8,
+		VSyncOffset: int(d[10]>>4) | int((d[11]>>2)&3)<<4,
+		VSyncWidth:  int(d[10]&0xf) | int(d[11]&3)<<4,
+		WidthMM:     int(d[12]) | int(d[14]>>4)<<8,
+		HeightMM:    int(d[13]) | int(d[14]&0xf)<<8,
+		HBorder:     int(d[15]),
+		VBorder:     int(d[16]),
+		Flags:       d[17],
+	}
+}
+
+func (t DetailedTiming) Bytes() []byte {
+	d := make([]byte, 18)
+	binary.LittleEndian.PutUint16(d, uint16(t.PixelClock/10))
+	d[2] = byte(t.HActive)
+	d[3] = byte(t.HBlank)
+	d[4] = byte(t.HActive>>8)<<4 | byte(t.HBlank>>8)&0xf
+	d[5] = byte(t.VActive)
+	d[6] = byte(t.VBlank)
+	d[7] = byte(t.VActive>>8)<<4 | byte(t.VBlank>>8)&0xf
+	d[8] = byte(t.HSyncOffset)
+	d[9] = byte(t.HSyncWidth)
+	d[10] = byte(t.VSyncOffset&0xf)<<4 | byte(t.VSyncWidth&0xf)
+	d[11] = byte(t.HSyncOffset>>8)<<6 | byte(t.HSyncWidth>>8&3)<<4 | byte(t.VSyncOffset>>4&3)<<2 | byte(t.VSyncWidth>>4&3)
+	d[12] = byte(t.WidthMM)
+	d[13] = byte(t.HeightMM)
+	d[14] = byte(t.WidthMM>>8)<<4 | byte(t.HeightMM>>8)&0xf
+	d[15] = byte(t.HBorder)
+	d[16] = byte(t.VBorder)
+	d[17] = t.Flags
+	return d
+}
+
+func (t DetailedTiming) Interlaced() bool {
+	return t.Flags&0x80 > 0
+}
+
+/* Height returns the frame height, for interlaced timings the descriptor stores the field height */
+func (t DetailedTiming) Height() int {
+	if t.Interlaced() {
+		return 2 * t.VActive
+	}
+	return t.VActive
+}
+
+func (t DetailedTiming) Refresh() float64 {
+	total := (t.HActive + t.HBlank) * (t.VActive + t.VBlank)
+	if total == 0 {
+		return 0
+	}
+	return float64(t.PixelClock) * 1000 / float64(total)
+}
+
+func (t DetailedTiming) String() string {
+	scan := "p"
+	if t.Interlaced() {
+		scan = "i"
+	}
+	return fmt.Sprintf("%dx%d%s%.2f (%d.%02d MHz)", t.HActive, t.Height(), scan, t.Refresh(), t.PixelClock/1000, t.PixelClock%1000/10)
+}
+
+/* CEA-861 timings used to replace a preferred timing that was removed */
+var (
+	Timing1080p60 = DetailedTiming{
+		PixelClock: 148500, HActive: 1920, HBlank: 280, HSyncOffset: 88, HSyncWidth: 44,
+		VActive: 1080, VBlank: 45, VSyncOffset: 4, VSyncWidth: 5, Flags: 0x1e,
+	}
+	Timing720p60 = DetailedTiming{
+		PixelClock: 74250, HActive: 1280, HBlank: 370, HSyncOffset: 110, HSyncWidth: 40,
+		VActive: 720, VBlank: 30, VSyncOffset: 5, VSyncWidth: 5, Flags: 0x1e,
+	}
+)
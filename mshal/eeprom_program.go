@@ -0,0 +1,104 @@
+package mshal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const eepromProgramPageSize = 16
+
+type EEPROMPageError struct {
+	Addr int
+	Err  error
+}
+
+func (e *EEPROMPageError) Error() string {
+	return fmt.Sprintf("page at %04x: %v", e.Addr, e.Err)
+}
+
+func (e *EEPROMPageError) Unwrap() error {
+	return e.Err
+}
+
+var errorVerify = errors.New("verification failed")
+
+func eepromProgramPage(region MemoryRegion, addr int, data []byte) error {
+	if _, err := region.Access(true, addr, data); err != nil {
+		return &EEPROMPageError{Addr: addr, Err: err}
+	}
+
+	readback := make([]byte, len(data))
+	if _, err := region.Access(false, addr, readback); err != nil {
+		return &EEPROMPageError{Addr: addr, Err: err}
+	}
+	if !bytes.Equal(readback, data) {
+		return &EEPROMPageError{Addr: addr, Err: errorVerify}
+	}
+
+	return nil
+}
+
+/* EEPROMProgram writes data at addr, skipping pages that are equal to orig (the current contents).
+ * Every page is verified after writing. If a page fails, the pages written so far are restored
+ * from orig. It returns the number of pages written and skipped. */
+func EEPROMProgram(region MemoryRegion, addr int, data []byte, orig []byte) (int, int, error) {
+	if len(orig) != len(data) {
+		return 0, 0, errors.New("original data must have the same length")
+	}
+	if addr+len(data) > region.GetLength() {
+		return 0, 0, errors.New("data does not fit in region")
+	}
+
+	/* Verify at least 16 bytes at a time, but always whole pages of the EEPROM */
+	page := RegionPageSize(region)
+	if page < eepromProgramPageSize {
+		page = eepromProgramPageSize
+	}
+
+	var written []int
+	skipped := 0
+
+	for offset := 0; offset < len(data); {
+		/* Pages are aligned to the EEPROM, not to addr */
+		end := (addr+offset)/page*page + page - addr
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if bytes.Equal(data[offset:end], orig[offset:end]) {
+			skipped++
+			offset = end
+			continue
+		}
+
+		written = append(written, offset)
+		if err := eepromProgramPage(region, addr+offset, data[offset:end]); err != nil {
+			return len(written), skipped, eepromRollback(region, addr, page, orig, written, err)
+		}
+
+		offset = end
+	}
+
+	return len(written), skipped, nil
+}
+
+/* eepromRollback restores every written page, a page that fails does not stop the others */
+func eepromRollback(region MemoryRegion, addr int, page int, orig []byte, written []int, cause error) error {
+	var errs []error
+	for _, offset := range written {
+		end := (addr+offset)/page*page + page - addr
+		if end > len(orig) {
+			end = len(orig)
+		}
+
+		if err := eepromProgramPage(region, addr+offset, orig[offset:end]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w (restoring original contents failed for %d of %d pages: %v)", cause, len(errs), len(written), errors.Join(errs...))
+	}
+	return fmt.Errorf("%w (original contents restored)", cause)
+}
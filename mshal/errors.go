@@ -11,4 +11,5 @@ var (
 	ErrorPatchFailed     = errors.New("Could not patch code")
 	ErrorMissingFunction = errors.New("This function is not supported in this mode")
 	ErrorNoAck           = errors.New("No ACK received")
+	ErrorPreflightFailed = errors.New("Firmware failed pre-flight compatibility check")
 )
@@ -2,8 +2,12 @@ package mshal
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/BertoldVdb/ms-tools/gohid"
+	"github.com/johnneerdael/ms-tools/mshal/sfdp"
 )
 
 type HAL struct {
@@ -12,6 +16,7 @@ type HAL struct {
 	deviceType      int
 	deviceTypeExtra int
 	eepromSize      int
+	eepromGeometry  *EEPROMGeometry
 
 	patchAllocAddr              int
 	patchCallAddrsExternalStart int
@@ -20,24 +25,52 @@ type HAL struct {
 	patchInstalled bool
 	patchCanCall   bool
 
+	i2cSoftSCL int /* Bit addresses of the I2C pins, found in the ROM when bit-banging */
+	i2cSoftSDA int
+
 	config           HALConfig
 	ms2130spiEnabled int
+	ms2130flash      *sfdp.Info
+	ms2130flashErr   error
 }
 
 type LogFunc func(level int, format string, param ...interface{})
 
 type HALConfig struct {
-	EEPromSize int
+	EEPromSize         int
+	EEPromPageSize     int           /* Defaults to the typical page size for the detected EEPROM */
+	EEPromAddrBytes    int           /* 1 or 2, defaults to 2 for EEPROMs larger than 2048 bytes */
+	EEPromWriteTimeout time.Duration /* Maximum write cycle time, defaults to 15ms */
+
+	I2CSpeed          int           /* Bit-bang the I2C bus at this speed in Hz, 0 uses the ROM functions */
+	I2CStretchTimeout time.Duration /* Maximum time a device may stretch the clock, defaults to 10ms */
+
+	SPIPins  *SPIPins /* Defaults to SCK=0, MOSI=1, MISO=2, CS=3 */
+	SPISpeed int      /* Clock speed in Hz, 0 is as fast as possible */
 
 	PatchTryInstall         bool
 	PatchIgnoreUserFirmware bool
 	PatchProbeEEPROM        bool
 	PatchBlobs              []CodeBlob
+	PatchROMImage           []byte /* ROM dump used to check the ROM helpers before patching */
 
 	LogFunc LogFunc
 }
 
 func New(dev gohid.HIDDevice, config HALConfig) (*HAL, error) {
+	if config.EEPromAddrBytes < 0 || config.EEPromAddrBytes > 2 {
+		return nil, errors.New("EEPROM address must be 1 or 2 bytes")
+	}
+	if config.EEPromPageSize < 0 || config.EEPromPageSize&(config.EEPromPageSize-1) != 0 {
+		return nil, errors.New("EEPROM page size must be a power of two")
+	}
+	if config.I2CSpeed < 0 {
+		return nil, errors.New("I2C speed can't be negative")
+	}
+	if config.I2CStretchTimeout < 0 || config.I2CStretchTimeout > time.Duration(i2cSoftStretchMax) {
+		return nil, fmt.Errorf("I2C clock stretch timeout must be at most %v", time.Duration(i2cSoftStretchMax))
+	}
+
 	h := &HAL{
 		dev:    dev,
 		config: config,
@@ -81,6 +114,13 @@ func New(dev gohid.HIDDevice, config HALConfig) (*HAL, error) {
 	}
 
 	if config.PatchTryInstall {
+		/* Check the pins before the bit-banged functions are installed */
+		if config.I2CSpeed > 0 {
+			if err := h.patchI2CSoftFindPins(); err != nil {
+				return nil, err
+			}
+		}
+
 		isNew, err := h.patchInstall()
 		if err != nil {
 			return nil, err
@@ -95,6 +135,12 @@ func New(dev gohid.HIDDevice, config HALConfig) (*HAL, error) {
 		}
 
 		h.patchInstalled = true
+
+		if config.I2CSpeed > 0 {
+			if err := h.patchI2CSoftConfigure(); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	h.eepromSize = config.EEPromSize
@@ -116,6 +162,7 @@ func New(dev gohid.HIDDevice, config HALConfig) (*HAL, error) {
 	}
 
 	h.config.LogFunc(1, "Assumed EEPROM Size: %d", h.eepromSize)
+	h.config.LogFunc(2, "EEPROM geometry: %d byte pages, %d address bytes, %v write timeout", h.eepromPageSize(), h.eepromAddrBytes(), h.eepromWriteTimeout())
 
 	/* MS2130 can be running code from flash that is pre-patched. This is a hack to allow
 	 * using that even withtout offset discovery */
@@ -148,6 +195,8 @@ const (
 	MemoryRegionB7_1             MemoryRegionNameType = "B7_1"
 	MemoryRegionB9               MemoryRegionNameType = "B9"
 	MemoryRegionFLASH            MemoryRegionNameType = "FLASH"
+	MemoryRegionI2CEEPROM        MemoryRegionNameType = "I2CEEPROM"
+	MemoryRegionSPIFlash         MemoryRegionNameType = "SPIFLASH"
 )
 
 type HookNameType string
@@ -166,3 +215,8 @@ func (h *HAL) GetDeviceType() string {
 
 	return "MS2109"
 }
+
+/* FirmwareCanCall tells if the MS213x firmware in flash announced itself with "BVDB" at 0x7b00 */
+func (h *HAL) FirmwareCanCall() bool {
+	return h.patchCanCall
+}
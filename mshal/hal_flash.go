@@ -1,7 +1,13 @@
 package mshal
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/johnneerdael/ms-tools/mshal/sfdp"
 )
 
 func (h *HAL) ms2130enableSPI(enable bool) error {
@@ -37,88 +43,382 @@ func (h *HAL) ms2130enableSPI(enable bool) error {
 	return err
 }
 
+/* The firmware talks to the flash with the SPI controller in SFR C8/C9, chip select is P2.2.
+ * A byte is sent by writing C9, C8.7 is set when it is done and C9 then holds the received byte. */
+const (
+	ms2130SFRP2        = 0xa0
+	ms2130SFRSPIStatus = 0xc8
+	ms2130SFRSPIData   = 0xc9
+
+	ms2130SPIDone = 0x80
+	ms2130SPICS   = 1 << 2
+)
+
+func (h *HAL) ms2130SPISelect(sfr MemoryRegion, selected bool) error {
+	var p2 [1]byte
+	if _, err := sfr.Access(false, ms2130SFRP2-0x80, p2[:]); err != nil {
+		return err
+	}
+
+	if selected {
+		p2[0] &= ^byte(ms2130SPICS)
+	} else {
+		p2[0] |= ms2130SPICS
+	}
+
+	_, err := sfr.Access(true, ms2130SFRP2-0x80, p2[:])
+	return err
+}
+
+func (h *HAL) ms2130SPIByte(sfr MemoryRegion, value byte) (byte, error) {
+	if _, err := sfr.Access(true, ms2130SFRSPIData-0x80, []byte{value}); err != nil {
+		return 0, err
+	}
+
+	var status [1]byte
+	for i := 0; ; i++ {
+		if _, err := sfr.Access(false, ms2130SFRSPIStatus-0x80, status[:]); err != nil {
+			return 0, err
+		}
+		if status[0]&ms2130SPIDone > 0 {
+			break
+		}
+		if i == 10 {
+			return 0, fmt.Errorf("SPI controller did not complete transfer: %w", ErrorTimeout)
+		}
+	}
+
+	/* Writing the flag back clears it */
+	if _, err := sfr.Access(true, ms2130SFRSPIStatus-0x80, status[:]); err != nil {
+		return 0, err
+	}
+
+	var result [1]byte
+	_, err := sfr.Access(false, ms2130SFRSPIData-0x80, result[:])
+	return result[0], err
+}
+
+/* ms2130FlashCommand sends tx to the flash followed by rxLen dummy bytes, and returns the bytes
+ * received during the dummy bytes */
+func (h *HAL) ms2130FlashCommand(tx []byte, rxLen int) ([]byte, error) {
+	if h.deviceType != 2130 {
+		return nil, ErrorMissingFunction
+	}
+	if err := h.ms2130enableSPI(true); err != nil {
+		return nil, err
+	}
+
+	sfr := h.MemoryRegionGet(MemoryRegionSFR)
+	if err := h.ms2130SPISelect(sfr, true); err != nil {
+		return nil, err
+	}
+
+	var rx []byte
+	var err error
+	for i := 0; i < len(tx)+rxLen && err == nil; i++ {
+		value := byte(0xff)
+		if i < len(tx) {
+			value = tx[i]
+		}
+
+		value, err = h.ms2130SPIByte(sfr, value)
+		if i >= len(tx) {
+			rx = append(rx, value)
+		}
+	}
+
+	if err2 := h.ms2130SPISelect(sfr, false); err == nil {
+		err = err2
+	}
+	return rx, err
+}
+
+const (
+	flashCmdReadStatus  = 0x05
+	flashCmdWriteEnable = 0x06
+
+	flashStatusBusy         = 1 << 0
+	flashStatusWriteEnabled = 1 << 1
+)
+
+/* Erasing a block of up to 64KB may take this long */
+const flashEraseTimeout = 3 * time.Second
+
+/* The firmware commands take 3 address bytes, so only the first 16MB can be accessed */
+const flashMaxSize = 1 << 24
+
+/* FlashInfo identifies the MS2130 flash from its JEDEC ID and SFDP tables. The result is kept,
+ * including a failure, so every region made from this HAL uses the same geometry. */
+func (h *HAL) FlashInfo() (sfdp.Info, error) {
+	if h.ms2130flash != nil {
+		return *h.ms2130flash, nil
+	}
+	if h.ms2130flashErr != nil {
+		return sfdp.Info{}, h.ms2130flashErr
+	}
+
+	info, err := sfdp.Identify(h.ms2130FlashCommand)
+	if err != nil {
+		h.ms2130flashErr = err
+		return info, err
+	}
+
+	if info.Size > flashMaxSize {
+		if h.config.LogFunc != nil {
+			h.config.LogFunc(1, "Flash is %d bytes, only the first %d bytes can be accessed", info.Size, flashMaxSize)
+		}
+		info.Size = flashMaxSize
+	}
+
+	h.ms2130flash = &info
+	return info, nil
+}
+
+/* flashGeometry returns the geometry of the MS2130 flash, or a 64KB flash if it can't be identified */
+func (h *HAL) flashGeometry() sfdp.Geometry {
+	info, err := h.FlashInfo()
+	if err == nil {
+		return info.Geometry
+	}
+
+	if h.config.LogFunc != nil {
+		h.config.LogFunc(1, "Failed to identify flash, assuming 64KB: %v", err)
+	}
+	return sfdp.Geometry{
+		Size:       0x10000,
+		PageSize:   256,
+		AddrBytes:  3,
+		EraseTypes: []sfdp.EraseType{{Size: 4096, Opcode: 0x20}, {Size: 65536, Opcode: 0xd8}},
+	}
+}
+
+func (h *HAL) ms2130FlashStatus() (byte, error) {
+	status, err := h.ms2130FlashCommand([]byte{flashCmdReadStatus}, 1)
+	if err != nil {
+		return 0, err
+	}
+	return status[0], nil
+}
+
+func (h *HAL) ms2130FlashWaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		expired := time.Now().After(deadline)
+
+		status, err := h.ms2130FlashStatus()
+		if err != nil {
+			return err
+		}
+		if status&flashStatusBusy == 0 {
+			return nil
+		}
+		if expired {
+			return fmt.Errorf("flash still busy after %v: %w", timeout, ErrorTimeout)
+		}
+	}
+}
+
+func (h *HAL) ms2130FlashErase(op byte, addr int, timeout time.Duration) error {
+	if _, err := h.ms2130FlashCommand([]byte{flashCmdWriteEnable}, 0); err != nil {
+		return err
+	}
+
+	status, err := h.ms2130FlashStatus()
+	if err != nil {
+		return err
+	}
+	if status&flashStatusWriteEnabled == 0 {
+		return fmt.Errorf("flash did not enable writing (status %02x)", status)
+	}
+
+	if _, err := h.ms2130FlashCommand([]byte{op, byte(addr >> 16), byte(addr >> 8), byte(addr)}, 0); err != nil {
+		return err
+	}
+	return h.ms2130FlashWaitReady(timeout)
+}
+
+/* FlashErase erases the range addr..addr+length of the MS2130 flash with the largest erase blocks
+ * that fit. The range must be aligned to the smallest erase block, usually 4KB. */
+func (h *HAL) FlashErase(addr int, length int) error {
+	if h.deviceType != 2130 {
+		return ErrorMissingFunction
+	}
+
+	g := h.flashGeometry()
+	if len(g.EraseTypes) == 0 {
+		return errors.New("flash erase sizes are unknown")
+	}
+
+	min := g.EraseTypes[0].Size
+	if addr%min != 0 || length%min != 0 {
+		return fmt.Errorf("erase must be aligned to %d bytes", min)
+	}
+	if addr < 0 || addr+length > g.Size {
+		return errors.New("erase range exceeds the flash")
+	}
+
+	for length > 0 {
+		e := g.EraseTypes[0]
+		for _, m := range g.EraseTypes {
+			if addr%m.Size == 0 && length >= m.Size {
+				e = m
+			}
+		}
+
+		if h.config.LogFunc != nil {
+			h.config.LogFunc(2, "Erasing flash %06x-%06x", addr, addr+e.Size-1)
+		}
+
+		if err := h.ms2130FlashErase(e.Opcode, addr, flashEraseTimeout*time.Duration(e.Size/65536+1)); err != nil {
+			return err
+		}
+
+		addr += e.Size
+		length -= e.Size
+	}
+
+	return nil
+}
+
+/* FlashEraseChip erases the whole MS2130 flash with the firmware command */
+func (h *HAL) FlashEraseChip() error {
+	if h.deviceType != 2130 {
+		return ErrorMissingFunction
+	}
+	if err := h.ms2130enableSPI(true); err != nil {
+		return err
+	}
+
+	var out [8]byte
+	out[0] = 0xfe
+	_, err := h.ROMExchangeReport(out[:])
+	return err
+}
+
 type romFlashMemoryRegion struct {
-	hal *HAL
+	hal      *HAL
+	geometry sfdp.Geometry
 
 	flashReadBufferValid bool
-	flashReadBufferPage  uint16
+	flashReadBufferAddr  int
 }
 
 func (h *HAL) memoryRegionFlash() MemoryRegion {
 	return regionWrapCompleteIO(&romFlashMemoryRegion{
-		hal: h,
+		hal:      h,
+		geometry: h.flashGeometry(),
 	})
 }
 
 func (r romFlashMemoryRegion) GetLength() int {
-	return 0x10000
+	return r.geometry.Size
 }
 
-func (r *romFlashMemoryRegion) Access(write bool, addr int, buf []byte) (int, error) {
-	if err := r.hal.ms2130enableSPI(true); err != nil {
-		return 0, err
+func (r romFlashMemoryRegion) GetPageSize() int {
+	return r.geometry.PageSize
+}
+
+/* program writes data within a single flash page */
+func (r *romFlashMemoryRegion) program(addr int, data []byte) error {
+	/* Setup flash write: f801aaaaaabbbb00 (aaaaaa=address, bbbb=blocksize) *
+	 * Write to the buffer: f800cccccccccc (cccccccccccc=data) */
+
+	var out [8]byte
+	out[0] = 0xf8
+	out[1] = 0x01
+	out[2] = byte(addr >> 16)
+	out[3] = byte(addr >> 8)
+	out[4] = byte(addr >> 0)
+	binary.BigEndian.PutUint16(out[5:], uint16(len(data)))
+
+	if _, err := r.hal.ROMExchangeReport(out[:]); err != nil {
+		return err
 	}
 
-	if write {
-		r.flashReadBufferValid = false
+	for len(data) > 0 {
+		out[0] = 0xf8
+		out[1] = 0x00
 
-		if addr == 0 {
-			/* Erase the flash first */
-			var out [8]byte
-			out[0] = 0xfe
-			if _, err := r.hal.ROMExchangeReport(out[:]); err != nil {
-				return 0, err
-			}
+		n := copy(out[2:], data)
+
+		if _, err := r.hal.ROMExchangeReport(out[:]); err != nil {
+			return err
 		}
 
-		/* Setup flash write: f801aaaaaabbbb00 (aaaaaa=address, bbbb=blocksize) *
-		 * Write to the buffer: f800cccccccccc (cccccccccccc=data) */
+		data = data[n:]
+	}
 
-		if len(buf) > 256 {
-			buf = buf[:256]
-		}
+	return nil
+}
 
-		var out [8]byte
-		out[0] = 0xf8
-		out[1] = 0x01
-		out[2] = byte(addr >> 16)
-		out[3] = byte(addr >> 8)
-		out[4] = byte(addr >> 0)
-		binary.BigEndian.PutUint16(out[5:], uint16(len(buf)))
+/* write updates the sector containing addr. It is only erased if bits have to be set, and only
+ * pages that changed are programmed. */
+func (r *romFlashMemoryRegion) write(addr int, buf []byte) (int, error) {
+	if len(r.geometry.EraseTypes) == 0 {
+		return 0, errors.New("flash erase sizes are unknown")
+	}
 
-		if _, err := r.hal.ROMExchangeReport(out[:]); err != nil {
+	sector := r.geometry.EraseTypes[0].Size
+	start := addr / sector * sector
+	if len(buf) > start+sector-addr {
+		buf = buf[:start+sector-addr]
+	}
+
+	old := make([]byte, sector)
+	for n := 0; n < len(old); {
+		m, err := r.read(start+n, old[n:])
+		if err != nil {
 			return 0, err
 		}
+		n += m
+	}
 
-		written := 0
-		for len(buf) > 0 {
-			out[0] = 0xf8
-			out[1] = 0x00
+	data := append([]byte{}, old...)
+	copy(data[addr-start:], buf)
+	if bytes.Equal(data, old) {
+		return len(buf), nil
+	}
 
-			n := copy(out[2:], buf)
+	r.flashReadBufferValid = false
 
-			if _, err := r.hal.ROMExchangeReport(out[:]); err != nil {
-				return written, err
+	for i := range data {
+		if old[i]&data[i] != data[i] {
+			if err := r.hal.FlashErase(start, sector); err != nil {
+				return 0, err
 			}
-
-			written += n
-			buf = buf[n:]
+			old = bytes.Repeat([]byte{0xff}, sector)
+			break
 		}
+	}
 
-		return written, nil
+	pageSize := r.geometry.PageSize
+	for offset := 0; offset < sector; offset += pageSize {
+		page := data[offset : offset+pageSize]
+		if bytes.Equal(page, old[offset:offset+pageSize]) {
+			continue
+		}
+		if err := r.program(start+offset, page); err != nil {
+			return 0, err
+		}
 	}
 
-	flashPage := uint16(addr >> 8)
-	flashOffset := uint8(addr & 0xff)
+	return len(buf), nil
+}
+
+func (r *romFlashMemoryRegion) read(addr int, buf []byte) (int, error) {
+	flashPage := addr &^ 0xff
+	flashOffset := addr & 0xff
 
 	/* Read from flash to buffer: f701aaaaaabbbb00 (aaaaaa=addr, bbbb=len to read)
 	 * Read from buffer to hostt: f700000000aaaa00 (aaaa=offset) */
 
-	if !r.flashReadBufferValid || r.flashReadBufferPage != flashPage {
+	if !r.flashReadBufferValid || r.flashReadBufferAddr != flashPage {
 		var out [8]byte
 		out[0] = 0xf7
 		out[1] = 0x01
-		binary.BigEndian.PutUint16(out[2:], flashPage)
+		out[2] = byte(flashPage >> 16)
+		out[3] = byte(flashPage >> 8)
+		out[4] = byte(flashPage >> 0)
 		binary.BigEndian.PutUint16(out[5:], 256)
 
 		if _, err := r.hal.ROMExchangeReport(out[:]); err != nil {
@@ -126,7 +426,7 @@ func (r *romFlashMemoryRegion) Access(write bool, addr int, buf []byte) (int, er
 		}
 
 		r.flashReadBufferValid = true
-		r.flashReadBufferPage = flashPage
+		r.flashReadBufferAddr = flashPage
 	}
 
 	var out [8]byte
@@ -137,7 +437,7 @@ func (r *romFlashMemoryRegion) Access(write bool, addr int, buf []byte) (int, er
 		return 0, err
 	}
 
-	maxLen := 0x100 - int(flashOffset)
+	maxLen := 0x100 - flashOffset
 	if len(buf) > maxLen {
 		buf = buf[:maxLen]
 	}
@@ -145,6 +445,24 @@ func (r *romFlashMemoryRegion) Access(write bool, addr int, buf []byte) (int, er
 	return copy(buf, in), nil
 }
 
+func (r *romFlashMemoryRegion) Access(write bool, addr int, buf []byte) (int, error) {
+	if addr >= r.GetLength() {
+		return 0, nil
+	}
+	if addr+len(buf) > r.GetLength() {
+		buf = buf[:r.GetLength()-addr]
+	}
+
+	if err := r.hal.ms2130enableSPI(true); err != nil {
+		return 0, err
+	}
+
+	if write {
+		return r.write(addr, buf)
+	}
+	return r.read(addr, buf)
+}
+
 func (r romFlashMemoryRegion) GetParent() (MemoryRegion, int) {
 	return nil, 0
 }
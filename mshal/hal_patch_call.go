@@ -64,6 +64,13 @@ func (h *HAL) PatchExecFunc(inIRQ bool, addr int, req PatchExecFuncRequest) (Pat
 		return response, ErrorMissingFunction
 	}
 
+	return h.patchExecFunc(inIRQ, addr, req)
+}
+
+/* patchExecFunc calls addr without checking that a patch is installed, the caller must know it is running */
+func (h *HAL) patchExecFunc(inIRQ bool, addr int, req PatchExecFuncRequest) (PatchExecFuncResponse, error) {
+	var response PatchExecFuncResponse
+
 	if req.DPTR != 0 && (req.R4 != 0 || req.R3 != 0) {
 		return response, errors.New("can't set both DPTR and R3/R4")
 	}
@@ -1,33 +1,23 @@
 package mshal
 
-func (h *HAL) patchEepromDetectSize() (int, error) {
-	eepromFound := 0
-	for i := byte(0x50); i <= 0x57; i++ {
-		ok, err := h.I2CTransfer(i, []byte{0}, nil)
-		if err != nil {
-			return 0, err
-		}
-		if !ok {
-			break
-		}
-		eepromFound++
-	}
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
-	if eepromFound == 0 {
-		return 0, nil
-	}
-
-	if eepromFound > 1 {
-		return eepromFound * 256, nil
+func (h *HAL) patchEepromDetectSize() (int, error) {
+	g, err := h.EEPROMProbe()
+	if err != nil {
+		return 0, err
 	}
 
-	if h.deviceType == 2109 {
-		/* If we find only one EEPROM we assume it is 16-bit addressable  since <256 byte EEPROMs
-		   make no sense for this application. To actually test it you need to write to the chip :( */
-		return 4096, nil
+	if h.config.LogFunc != nil {
+		h.config.LogFunc(1, "EEPROM probe: %s", g)
 	}
 
-	return 256, nil
+	h.eepromGeometry = g
+	return g.Size, nil
 }
 
 func (h *HAL) patchEEPROMUnlock(unlock bool) error {
@@ -40,16 +30,57 @@ func (h *HAL) patchEEPROMUnlock(unlock bool) error {
 	return nil
 }
 
+func (h *HAL) eepromPageSize() int {
+	if h.config.EEPromPageSize > 0 {
+		return h.config.EEPromPageSize
+	}
+	if h.eepromGeometry != nil && h.eepromGeometry.PageSize > 0 {
+		return h.eepromGeometry.PageSize
+	}
+	return 16
+}
+
+func (h *HAL) eepromAddrBytes() int {
+	if h.config.EEPromAddrBytes > 0 {
+		return h.config.EEPromAddrBytes
+	}
+	/* The probe only proves 16-bit addressing, a single byte result can come from a device
+	 * that read from its address counter */
+	if h.eepromGeometry != nil && h.eepromGeometry.AddrConfidence == EEPROMConfidenceHigh {
+		return h.eepromGeometry.AddrBytes
+	}
+	if h.eepromSize > 2048 {
+		return 2
+	}
+	return 1
+}
+
+func (h *HAL) eepromWriteTimeout() time.Duration {
+	if h.config.EEPromWriteTimeout > 0 {
+		return h.config.EEPromWriteTimeout
+	}
+	return 15 * time.Millisecond
+}
+
 type halPatchEEPROMMemoryRegion struct {
-	hal *HAL
+	hal  *HAL
+	name MemoryRegionNameType
+
+	devAddr   uint8
+	size      int
+	addrBytes int
+	pageSize  int
+
+	/* Only the boot EEPROM has a write protect pin controlled by the chip */
+	writeProtect bool
 }
 
 func (h halPatchEEPROMMemoryRegion) GetName() MemoryRegionNameType {
-	return MemoryRegionEEPROM
+	return h.name
 }
 
 func (h halPatchEEPROMMemoryRegion) GetLength() int {
-	return h.hal.eepromSize
+	return h.size
 }
 
 func (h halPatchEEPROMMemoryRegion) GetParent() (MemoryRegion, int) {
@@ -60,10 +91,15 @@ func (h halPatchEEPROMMemoryRegion) read(addr int, buf []byte) (int, error) {
 	var ok bool
 	var err error
 
-	if h.GetLength() <= 2048 {
-		ok, err = h.hal.I2CTransfer(0x50+byte(addr>>8), []byte{byte(addr)}, buf)
+	/* Stay within a single batched I2C transfer */
+	if len(buf) > i2cTransferBatchMax-h.addrBytes {
+		buf = buf[:i2cTransferBatchMax-h.addrBytes]
+	}
+
+	if h.addrBytes == 1 {
+		ok, err = h.hal.I2CTransfer(h.devAddr+byte(addr>>8), []byte{byte(addr)}, buf)
 	} else {
-		ok, err = h.hal.I2CTransfer(0x50, []byte{byte(addr >> 8), byte(addr)}, buf)
+		ok, err = h.hal.I2CTransfer(h.devAddr, []byte{byte(addr >> 8), byte(addr)}, buf)
 	}
 
 	if err != nil {
@@ -77,32 +113,34 @@ func (h halPatchEEPROMMemoryRegion) read(addr int, buf []byte) (int, error) {
 }
 
 func (h halPatchEEPROMMemoryRegion) write(addr int, buf []byte) (int, error) {
-	if err := h.hal.patchEEPROMUnlock(true); err != nil {
-		return 0, err
+	if h.writeProtect {
+		if err := h.hal.patchEEPROMUnlock(true); err != nil {
+			return 0, err
+		}
+		defer h.hal.patchEEPROMUnlock(false)
 	}
-	defer h.hal.patchEEPROMUnlock(false)
 
-	/* We can write 16-byte pages */
-	endOfPage := (addr + 16) / 16 * 16
+	/* Writes must not cross a page boundary */
+	pageSize := h.pageSize
+	endOfPage := (addr + pageSize) / pageSize * pageSize
 	bytesRemaining := endOfPage - addr
 
 	if len(buf) > bytesRemaining {
 		buf = buf[:bytesRemaining]
 	}
 
-	var workBuf [16 + 2]byte
-	copy(workBuf[2:], buf)
-	workBuf[0] = byte(addr >> 8)
-	workBuf[1] = byte(addr)
-	wrBuf := workBuf[:len(buf)+2]
+	wrBuf := make([]byte, len(buf)+2)
+	copy(wrBuf[2:], buf)
+	wrBuf[0] = byte(addr >> 8)
+	wrBuf[1] = byte(addr)
 
 	var ok bool
 	var err error
 
-	if h.GetLength() <= 2048 {
-		ok, err = h.hal.I2CTransfer(0x50+byte(addr>>8), wrBuf[1:], nil)
+	if h.addrBytes == 1 {
+		ok, err = h.hal.I2CTransfer(h.devAddr+byte(addr>>8), wrBuf[1:], nil)
 	} else {
-		ok, err = h.hal.I2CTransfer(0x50, wrBuf, nil)
+		ok, err = h.hal.I2CTransfer(h.devAddr, wrBuf, nil)
 	}
 
 	if err != nil {
@@ -112,15 +150,22 @@ func (h halPatchEEPROMMemoryRegion) write(addr int, buf []byte) (int, error) {
 		return 0, ErrorNoAck
 	}
 
-	/* The EEPROM is working now, poll it to know when ACK received */
+	/* The EEPROM does not ACK while it is writing, poll it until it does. The last poll
+	 * happens after the timeout has passed. */
+	deadline := time.Now().Add(h.hal.eepromWriteTimeout())
 	for {
-		_, err := h.read(0, []byte{0})
+		expired := time.Now().After(deadline)
+
+		_, err := h.read(addr, []byte{0})
 		if err == nil {
 			break
 		}
 		if err != ErrorNoAck {
 			return 0, err
 		}
+		if expired {
+			return 0, fmt.Errorf("EEPROM did not finish writing at %04x within %v: %w", addr, h.hal.eepromWriteTimeout(), ErrorTimeout)
+		}
 	}
 
 	return len(buf), nil
@@ -130,6 +175,10 @@ func (h halPatchEEPROMMemoryRegion) GetAlignment() int {
 	return 1
 }
 
+func (h halPatchEEPROMMemoryRegion) GetPageSize() int {
+	return h.pageSize
+}
+
 func (h halPatchEEPROMMemoryRegion) Access(write bool, addr int, buf []byte) (int, error) {
 	if len(buf) == 0 {
 		return 0, nil
@@ -154,5 +203,53 @@ func (h *HAL) patchMakeEEPROMRegion() MemoryRegion {
 		return nil
 	}
 
-	return regionWrapCompleteIO(halPatchEEPROMMemoryRegion{hal: h})
+	return regionWrapCompleteIO(halPatchEEPROMMemoryRegion{
+		hal:          h,
+		name:         MemoryRegionEEPROM,
+		devAddr:      0x50,
+		size:         h.eepromSize,
+		addrBytes:    h.eepromAddrBytes(),
+		pageSize:     h.eepromPageSize(),
+		writeProtect: true,
+	})
+}
+
+/* MemoryRegionI2CEEPROM returns a region for a 24Cxx compatible EEPROM at devAddr. For single byte
+ * addressing, parts larger than 256 bytes use the following I2C addresses for the upper bits. */
+func (h *HAL) MemoryRegionI2CEEPROM(devAddr uint8, size int, addrBytes int, pageSize int) (MemoryRegion, error) {
+	if !h.patchInstalled {
+		return nil, ErrorMissingFunction
+	}
+
+	if addrBytes == 0 {
+		addrBytes = 1
+		if size > 2048 {
+			addrBytes = 2
+		}
+	}
+	if pageSize == 0 {
+		pageSize = eepromTypicalPageSize(size)
+	}
+
+	if size <= 0 || size > 65536 {
+		return nil, errors.New("EEPROM size must be between 1 and 65536 bytes")
+	}
+	if addrBytes < 1 || addrBytes > 2 {
+		return nil, errors.New("EEPROM address must be 1 or 2 bytes")
+	}
+	if pageSize&(pageSize-1) != 0 {
+		return nil, errors.New("EEPROM page size must be a power of two")
+	}
+	if devAddr > 0x7f || (addrBytes == 1 && int(devAddr)+(size-1)>>8 > 0x7f) {
+		return nil, errors.New("EEPROM does not fit in the I2C address space")
+	}
+
+	return regionWrapCompleteIO(halPatchEEPROMMemoryRegion{
+		hal:       h,
+		name:      MemoryRegionI2CEEPROM,
+		devAddr:   devAddr,
+		size:      size,
+		addrBytes: addrBytes,
+		pageSize:  pageSize,
+	}), nil
 }
@@ -0,0 +1,230 @@
+package mshal
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type EEPROMConfidence int
+
+const (
+	EEPROMConfidenceGuess EEPROMConfidence = iota
+	EEPROMConfidenceLow
+	EEPROMConfidenceMedium
+	EEPROMConfidenceHigh
+)
+
+func (c EEPROMConfidence) String() string {
+	switch c {
+	case EEPROMConfidenceLow:
+		return "low"
+	case EEPROMConfidenceMedium:
+		return "medium"
+	case EEPROMConfidenceHigh:
+		return "high"
+	}
+	return "guess"
+}
+
+type EEPROMGeometry struct {
+	Devices int
+
+	Size           int
+	SizeConfidence EEPROMConfidence
+
+	AddrBytes      int
+	AddrConfidence EEPROMConfidence
+
+	/* Writing is needed to measure the page size, so it is assumed from the typical part of this size */
+	PageSize int
+}
+
+func (g *EEPROMGeometry) String() string {
+	if g.Devices == 0 {
+		return "no EEPROM found"
+	}
+
+	return fmt.Sprintf("%d bytes (%s), %d-bit addressing (%s), %d byte pages (assumed), %d I2C address(es)",
+		g.Size, g.SizeConfidence, 8*g.AddrBytes, g.AddrConfidence, g.PageSize, g.Devices)
+}
+
+func eepromTypicalPageSize(size int) int {
+	if size <= 256 {
+		return 8
+	} else if size <= 2048 {
+		return 16
+	} else if size <= 8192 {
+		return 32
+	} else if size <= 32768 {
+		return 64
+	}
+	return 128
+}
+
+func eepromIsUniform(buf []byte) bool {
+	for _, m := range buf {
+		if m != buf[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *HAL) eepromProbeRead(addr []byte, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	ok, err := h.I2CTransfer(0x50, addr, buf)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrorNoAck
+	}
+	return buf, nil
+}
+
+/* eepromProbeAddrWidth uses dummy-write/random-read: an 8-bit device takes the second address byte as
+ * data, so the read position does not depend on it. The write is never completed as there is no stop
+ * condition before the read. */
+func (h *HAL) eepromProbeAddrWidth() (int, EEPROMConfidence, error) {
+	for _, offset := range []byte{0x10, 0x20, 0x40, 0x80} {
+		a, err := h.eepromProbeRead([]byte{0, 0}, 16)
+		if err != nil {
+			return 0, 0, err
+		}
+		b, err := h.eepromProbeRead([]byte{0, offset}, 16)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !bytes.Equal(a, b) {
+			return 2, EEPROMConfidenceHigh, nil
+		}
+
+		/* Uniform contents read the same from any address, the single byte reads could only
+		 * differ by where the address counter of a 16-bit device happens to be */
+		if eepromIsUniform(a) {
+			continue
+		}
+
+		/* The contents differ when using single byte addresses, so the second byte was ignored */
+		c, err := h.eepromProbeRead([]byte{0}, 16)
+		if err != nil {
+			return 0, 0, err
+		}
+		d, err := h.eepromProbeRead([]byte{offset}, 16)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !bytes.Equal(c, d) {
+			return 1, EEPROMConfidenceMedium, nil
+		}
+	}
+
+	if h.deviceType == 2109 {
+		return 2, EEPROMConfidenceGuess, nil
+	}
+	return 1, EEPROMConfidenceGuess, nil
+}
+
+/* eepromProbeWrap finds the smallest size at which the contents repeat, as address bits above the
+ * capacity are ignored by the EEPROM */
+func (h *HAL) eepromProbeWrap(addrBytes int, sizes []int) (int, EEPROMConfidence, error) {
+	makeAddr := func(addr int) []byte {
+		if addrBytes == 1 {
+			return []byte{byte(addr)}
+		}
+		return []byte{byte(addr >> 8), byte(addr)}
+	}
+
+	base, err := h.eepromProbeRead(makeAddr(0), 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, size := range sizes[:len(sizes)-1] {
+		m, err := h.eepromProbeRead(makeAddr(size), 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !bytes.Equal(m, base) {
+			continue
+		}
+
+		if eepromIsUniform(base) {
+			return size, EEPROMConfidenceLow, nil
+		}
+
+		/* Check a second location to rule out a copy of the same data */
+		a, err := h.eepromProbeRead(makeAddr(size/2), 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		b, err := h.eepromProbeRead(makeAddr(size+size/2), 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		if bytes.Equal(a, b) {
+			return size, EEPROMConfidenceHigh, nil
+		}
+		return size, EEPROMConfidenceMedium, nil
+	}
+
+	if eepromIsUniform(base) {
+		return sizes[len(sizes)-1], EEPROMConfidenceLow, nil
+	}
+	return sizes[len(sizes)-1], EEPROMConfidenceHigh, nil
+}
+
+/* EEPROMProbe determines the EEPROM geometry without writing to it */
+func (h *HAL) EEPROMProbe() (*EEPROMGeometry, error) {
+	if !h.patchInstalled {
+		return nil, ErrorMissingFunction
+	}
+
+	/* Nothing here should write, but make sure a misinterpreted address byte can't be stored */
+	if err := h.patchEEPROMUnlock(false); err != nil {
+		return nil, err
+	}
+
+	g := &EEPROMGeometry{}
+	for i := byte(0x50); i <= 0x57; i++ {
+		ok, err := h.I2CTransfer(i, []byte{0}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		g.Devices++
+	}
+
+	if g.Devices == 0 {
+		return g, nil
+	}
+
+	if g.Devices > 1 {
+		/* 24C04/08/16 use the I2C address for the upper address bits */
+		g.AddrBytes = 1
+		g.AddrConfidence = EEPROMConfidenceHigh
+		g.Size = g.Devices * 256
+		g.SizeConfidence = EEPROMConfidenceHigh
+	} else {
+		var err error
+		g.AddrBytes, g.AddrConfidence, err = h.eepromProbeAddrWidth()
+		if err != nil {
+			return nil, err
+		}
+
+		if g.AddrBytes == 1 {
+			g.Size, g.SizeConfidence, err = h.eepromProbeWrap(1, []int{128, 256})
+		} else {
+			g.Size, g.SizeConfidence, err = h.eepromProbeWrap(2, []int{4096, 8192, 16384, 32768, 65536})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g.PageSize = eepromTypicalPageSize(g.Size)
+
+	return g, nil
+}
@@ -1,31 +1,42 @@
 package mshal
 
-func (h *HAL) patchI2CStart() error {
-	addr := 0x3639
-	if h.deviceType == 2107 {
-		addr = 0x68bd
-	} else if h.deviceType == 2109 {
-		addr = 0x6a8c
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/* i2cSoftAddr returns the address of a bit-banged I2C function, or 0 if the ROM functions are used */
+func (h *HAL) i2cSoftAddr(entry int) int {
+	if h.config.I2CSpeed == 0 || !h.patchInstalled {
+		return 0
 	}
+	return h.patchCallAddrs[7] + entry
+}
 
+func (h *HAL) patchI2CStart() error {
+	addr := h.patchProfileGet().i2cStart
+	if soft := h.i2cSoftAddr(i2cSoftStart); soft != 0 {
+		addr = soft
+	}
 	_, err := h.PatchExecFunc(true, addr, PatchExecFuncRequest{})
 	return err
 }
 
 func (h *HAL) patchI2CStop() error {
-	addr := 0x3730
-	if h.deviceType == 2107 {
-		addr = 0x6b5b
-	} else if h.deviceType == 2109 {
-		addr = 0x6aba
+	addr := h.patchProfileGet().i2cStop
+	if soft := h.i2cSoftAddr(i2cSoftStop); soft != 0 {
+		addr = soft
 	}
 	_, err := h.PatchExecFunc(true, addr, PatchExecFuncRequest{})
 	return err
 }
 
 func (h *HAL) patchI2CRead(ack bool) (uint8, error) {
-	addr := 0x26cb
-	if h.deviceType == 2109 || h.deviceType == 2107 {
+	addr := h.patchProfileGet().i2cRead
+	if soft := h.i2cSoftAddr(i2cSoftRead); soft != 0 {
+		addr = soft
+	} else if h.deviceType == 2109 || h.deviceType == 2107 {
 		addr = h.patchCallAddrs[3]
 	}
 	r7 := byte(1)
@@ -37,65 +48,217 @@ func (h *HAL) patchI2CRead(ack bool) (uint8, error) {
 }
 
 func (h *HAL) patchI2CWrite(value uint8) (bool, error) {
-	addr := 0x2126
-	if h.deviceType == 2107 {
-		addr = 0x5323
-	} else if h.deviceType == 2109 {
-		addr = 0x4648
+	if soft := h.i2cSoftAddr(i2cSoftWrite); soft != 0 {
+		resp, err := h.PatchExecFunc(true, soft, PatchExecFuncRequest{R7_A: value})
+		return resp.C, err
 	}
-	resp, err := h.PatchExecFunc(true, addr, PatchExecFuncRequest{R7_A: value})
+
+	resp, err := h.PatchExecFunc(true, h.patchProfileGet().i2cWrite, PatchExecFuncRequest{R7_A: value})
 	if h.deviceType != 2106 {
 		return resp.C, err
 	}
 	return resp.R7 > 0, err
 }
 
-func (h *HAL) I2CTransfer(addr uint8, wrBuf []byte, rdBuf []byte) (bool, error) {
-	if !h.patchInstalled {
-		return false, ErrorMissingFunction
+type I2CMessage struct {
+	Addr uint8
+	Read bool
+	Data []byte /* Bytes to write, or buffer for the bytes to read */
+}
+
+/* I2CNackError tells which byte of a transfer was not acknowledged */
+type I2CNackError struct {
+	Message int
+	Addr    uint8
+	Byte    int /* -1 for the address */
+}
+
+func (e *I2CNackError) Error() string {
+	if e.Byte < 0 {
+		return fmt.Sprintf("No ACK for address %02x (message %d)", e.Addr, e.Message)
 	}
+	return fmt.Sprintf("No ACK for byte %d written to %02x (message %d)", e.Byte, e.Addr, e.Message)
+}
 
-	if len(rdBuf) == 0 && len(wrBuf) == 0 {
-		return true, nil
+func (e *I2CNackError) Is(target error) bool {
+	return target == ErrorNoAck
+}
 
+/* A single write followed by a single read can be done by the transfer blob. A single write
+ * can be empty, this only sends the address (quick write). */
+func i2cMessagesBatchable(msgs []I2CMessage, noStop bool) bool {
+	if noStop || len(msgs) > 2 {
+		return false
 	}
-	if len(wrBuf) > 0 {
-		if err := h.patchI2CStart(); err != nil {
-			return false, err
-		}
 
-		if ack, err := h.patchI2CWrite(addr << 1); !ack || err != nil {
-			return false, err
+	total := 0
+	for _, m := range msgs {
+		total += len(m.Data)
+	}
+	if total > i2cTransferBatchMax {
+		return false
+	}
+
+	if len(msgs) == 2 {
+		return !msgs[0].Read && len(msgs[0].Data) > 0 && msgs[1].Read && msgs[0].Addr == msgs[1].Addr
+	}
+	return true
+}
+
+func (h *HAL) i2cTransferMessagesBatch(msgs []I2CMessage) error {
+	var wrBuf, rdBuf []byte
+	for _, m := range msgs {
+		if m.Read {
+			rdBuf = m.Data
+		} else {
+			wrBuf = m.Data
 		}
+	}
+
+	status, err := h.patchI2CTransferBatch(msgs[0].Addr, wrBuf, rdBuf)
+	if err != nil || status == 0 {
+		return err
+	}
+
+	if status == 0xff {
+		return &I2CNackError{Message: len(msgs) - 1, Addr: msgs[0].Addr, Byte: -1}
+	}
+	return &I2CNackError{Addr: msgs[0].Addr, Byte: status - 2}
+}
 
-		for _, m := range wrBuf {
-			if ack, err := h.patchI2CWrite(m); !ack || err != nil {
-				return false, err
+func (h *HAL) i2cTransferMessage(index int, m I2CMessage) error {
+	if err := h.patchI2CStart(); err != nil {
+		return err
+	}
+
+	addr := m.Addr << 1
+	if m.Read {
+		addr |= 1
+	}
+	if ack, err := h.patchI2CWrite(addr); err != nil {
+		return err
+	} else if !ack {
+		return &I2CNackError{Message: index, Addr: m.Addr, Byte: -1}
+	}
+
+	for i, value := range m.Data {
+		if m.Read {
+			value, err := h.patchI2CRead(i < len(m.Data)-1)
+			if err != nil {
+				return err
 			}
+			m.Data[i] = value
+		} else if ack, err := h.patchI2CWrite(value); err != nil {
+			return err
+		} else if !ack {
+			return &I2CNackError{Message: index, Addr: m.Addr, Byte: i}
 		}
 	}
 
-	if len(rdBuf) > 0 {
-		if err := h.patchI2CStart(); err != nil {
-			return false, err
-		}
+	return nil
+}
+
+/* I2CTransferMessages performs the messages with repeated starts in between. The bus is released
+ * at the end unless noStop is set, or when a byte is not acknowledged. */
+func (h *HAL) I2CTransferMessages(msgs []I2CMessage, noStop bool) error {
+	if !h.patchInstalled {
+		return ErrorMissingFunction
+	}
 
-		if ack, err := h.patchI2CWrite(addr<<1 | 1); !ack || err != nil {
-			return false, err
+	if len(msgs) == 0 {
+		return nil
+	}
+	for _, m := range msgs {
+		if m.Read && len(m.Data) == 0 {
+			return errors.New("read messages need at least one byte")
 		}
+	}
 
-		for i := range rdBuf {
-			value, err := h.patchI2CRead(i < len(rdBuf)-1)
-			if err != nil {
-				return false, err
+	if i2cMessagesBatchable(msgs, noStop) {
+		return h.i2cTransferMessagesBatch(msgs)
+	}
+
+	for i, m := range msgs {
+		if err := h.i2cTransferMessage(i, m); err != nil {
+			if errors.Is(err, ErrorNoAck) {
+				if err := h.patchI2CStop(); err != nil {
+					return err
+				}
 			}
-			rdBuf[i] = value
+			return err
+		}
+	}
+
+	if noStop {
+		return nil
+	}
+	return h.patchI2CStop()
+}
+
+func (h *HAL) I2CTransfer(addr uint8, wrBuf []byte, rdBuf []byte) (bool, error) {
+	var msgs []I2CMessage
+	if len(wrBuf) > 0 {
+		msgs = append(msgs, I2CMessage{Addr: addr, Data: wrBuf})
+	}
+	if len(rdBuf) > 0 {
+		msgs = append(msgs, I2CMessage{Addr: addr, Read: true, Data: rdBuf})
+	}
+
+	err := h.I2CTransferMessages(msgs, false)
+	if errors.Is(err, ErrorNoAck) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *HAL) I2CReadReg8(addr uint8, reg uint8) (uint8, error) {
+	var buf [1]byte
+	err := h.I2CTransferMessages([]I2CMessage{{Addr: addr, Data: []byte{reg}}, {Addr: addr, Read: true, Data: buf[:]}}, false)
+	return buf[0], err
+}
+
+func (h *HAL) I2CWriteReg8(addr uint8, reg uint8, value uint8) error {
+	return h.I2CTransferMessages([]I2CMessage{{Addr: addr, Data: []byte{reg, value}}}, false)
+}
+
+/* 16-bit registers are transferred MSB first */
+func (h *HAL) I2CReadReg16(addr uint8, reg uint8) (uint16, error) {
+	var buf [2]byte
+	err := h.I2CTransferMessages([]I2CMessage{{Addr: addr, Data: []byte{reg}}, {Addr: addr, Read: true, Data: buf[:]}}, false)
+	return binary.BigEndian.Uint16(buf[:]), err
+}
+
+func (h *HAL) I2CWriteReg16(addr uint8, reg uint8, value uint16) error {
+	return h.I2CTransferMessages([]I2CMessage{{Addr: addr, Data: []byte{reg, byte(value >> 8), byte(value)}}}, false)
+}
+
+type I2CProbeMode int
+
+const (
+	I2CProbeAuto  I2CProbeMode = iota /* Like i2cdetect: read byte for EEPROM ranges, quick write otherwise */
+	I2CProbeQuick                     /* Address with write bit and no data */
+	I2CProbeRead                      /* Read one byte */
+)
+
+/* I2CProbe checks if a device acknowledges addr without writing data to it */
+func (h *HAL) I2CProbe(addr uint8, mode I2CProbeMode) (bool, error) {
+	if mode == I2CProbeAuto {
+		mode = I2CProbeQuick
+		/* Quick writes can corrupt the write protect of some EEPROMs */
+		if (addr >= 0x30 && addr <= 0x37) || (addr >= 0x50 && addr <= 0x5f) {
+			mode = I2CProbeRead
 		}
 	}
 
-	if err := h.patchI2CStop(); err != nil {
-		return false, err
+	msg := I2CMessage{Addr: addr}
+	if mode == I2CProbeRead {
+		msg.Read = true
+		msg.Data = make([]byte, 1)
 	}
 
-	return true, nil
+	err := h.I2CTransferMessages([]I2CMessage{msg}, false)
+	if errors.Is(err, ErrorNoAck) {
+		return false, nil
+	}
+	return err == nil, err
 }
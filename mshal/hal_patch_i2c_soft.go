@@ -0,0 +1,197 @@
+package mshal
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//go:embed asm/i2c_soft.bin
+var codeI2CSoft []byte
+
+/* Offsets of the addresses in i2c_soft.bin that point into the blob itself */
+var codeI2CSoftRelocs = []int{1, 4, 7, 10, 13, 16, 19, 22, 25, 28, 31, 34, 37, 40, 49, 52, 57, 60, 66, 74, 77, 83, 93, 96, 99}
+
+/* Offsets of the placeholders in i2c_soft.bin that are filled in by patchI2CSoftConfigure */
+var codeI2CSoftSCL = []int{108, 112, 118}
+var codeI2CSoftSDA = []int{47, 63, 80, 91, 102, 105}
+
+const (
+	codeI2CSoftStretch = 116
+	codeI2CSoftDelay0  = 125
+	codeI2CSoftDelay1  = 127
+)
+
+/* Entry points of i2c_soft.bin, in the same order as the stubs of i2c_txfr.bin */
+const (
+	i2cSoftStart = 0
+	i2cSoftStop  = 3
+	i2cSoftWrite = 6
+	i2cSoftRead  = 9
+)
+
+/* One iteration of the delay loop takes two machine cycles, like in UARTTransmit. The code around
+ * the delay takes about 7 more iterations per half clock period. */
+const (
+	i2cSoftLoopTime = 108.125e-9
+	i2cSoftOverhead = 7
+)
+
+/* Waiting for a stretched clock polls 256 times per count, with two loop times per poll */
+const i2cSoftStretchMax = 256 * 256 * 2 * i2cSoftLoopTime * float64(time.Second)
+
+func relocateI2CSoft(result []byte, addr int) (int, []byte) {
+	for _, m := range codeI2CSoftRelocs {
+		if result[m-1] != 0x12 && result[m-1] != 0x02 {
+			panic("Offset is not LCALL or LJMP")
+		}
+
+		target := binary.BigEndian.Uint16(result[m:])
+		binary.BigEndian.PutUint16(result[m:], target+uint16(addr))
+	}
+
+	return addr, result
+}
+
+/* bitBangDelay returns the delay loop count for a clock speed and the speed it gives, overhead is
+ * the time taken by the other instructions in each half clock period in loop iterations */
+func bitBangDelay(speed int, overhead int) (uint16, int) {
+	n := int(1/(2*float64(speed))/i2cSoftLoopTime) - overhead
+	if n < 0 {
+		n = 0
+	} else if n > 0xffff {
+		n = 0xffff
+	}
+
+	return uint16(n), int(1 / (2 * float64(n+overhead) * i2cSoftLoopTime))
+}
+
+func (h *HAL) i2cStretchTimeout() time.Duration {
+	if h.config.I2CStretchTimeout > 0 {
+		return h.config.I2CStretchTimeout
+	}
+	return 10 * time.Millisecond
+}
+
+/* patchI2CSoftFindPins finds the I2C pins in the ROM I2C start function before the bit-banged
+ * functions are installed. CODE is read from PatchROMImage or through the running patch. If
+ * neither is available the patch is installed without the bit-banged functions first. */
+func (h *HAL) patchI2CSoftFindPins() error {
+	speed := h.config.I2CSpeed
+	defer func() {
+		h.config.I2CSpeed = speed
+	}()
+
+	code := h.patchROMCode(nil)
+	for _, m := range []int{speed, 0} {
+		if code != nil {
+			break
+		}
+
+		h.config.I2CSpeed = m
+		installBlobs, err := h.patchBlobsGet()
+		if err != nil {
+			return err
+		}
+		callAddrs, err := h.patchFind(installBlobs, h.patchChecksum(installBlobs))
+		if err != nil {
+			return err
+		}
+		code = h.patchROMCode(callAddrs)
+	}
+
+	if code == nil {
+		h.config.I2CSpeed = 0
+		if _, err := h.patchInstall(); err != nil {
+			return err
+		}
+		code = h.patchROMCode(h.patchCallAddrs)
+	}
+
+	p := h.patchProfileGet()
+	start, err := romFuncRead(code, p.i2cStart)
+	if err != nil {
+		return err
+	}
+	scl, sda, ok := start.i2cPins()
+	if !ok {
+		return errors.New("could not find the I2C pins in the ROM I2C start function")
+	}
+
+	/* The stop function must release the same pins */
+	stop, err := romFuncRead(code, p.i2cStop)
+	if err != nil {
+		return err
+	}
+	if checkI2CStop(stop, scl, sda) != "" {
+		return fmt.Errorf("ROM I2C stop function does not release the pins of the start function (SCL %02X.%d, SDA %02X.%d)",
+			scl&0xf8, scl&7, sda&0xf8, sda&7)
+	}
+
+	h.i2cSoftSCL, h.i2cSoftSDA = scl, sda
+	return nil
+}
+
+/* patchI2CSoftConfigure fills in the pins and delays of the bit-banged I2C functions, and points
+ * the stubs of the I2C transfer blob to them. */
+func (h *HAL) patchI2CSoftConfigure() error {
+	scl, sda := h.i2cSoftSCL, h.i2cSoftSDA
+
+	delay, speed := bitBangDelay(h.config.I2CSpeed, i2cSoftOverhead)
+	stretch := int(float64(h.i2cStretchTimeout())/i2cSoftStretchMax*256 + 0.5)
+	if stretch < 1 {
+		stretch = 1
+	}
+
+	if h.config.LogFunc != nil {
+		h.config.LogFunc(1, "Bit-banged I2C: SCL %02X.%d, SDA %02X.%d, %d Hz (requested %d Hz)", scl&0xf8, scl&7, sda&0xf8, sda&7, speed, h.config.I2CSpeed)
+	}
+
+	ram := h.MemoryRegionGet(MemoryRegionRAM)
+	blob := h.patchCallAddrs[7]
+
+	var err error
+	write := func(addr int, data ...byte) {
+		if err == nil {
+			_, err = ram.Access(true, addr, data)
+		}
+	}
+
+	for _, m := range codeI2CSoftSCL {
+		write(blob+m, byte(scl))
+	}
+	for _, m := range codeI2CSoftSDA {
+		write(blob+m, byte(sda))
+	}
+
+	/* The loops count down from these values, like in UARTTransmit */
+	write(blob+codeI2CSoftDelay0, byte(delay)+1)
+	write(blob+codeI2CSoftDelay1, byte(delay>>8)+1)
+	write(blob+codeI2CSoftStretch, byte(stretch))
+
+	for i, m := range []int{i2cSoftStart, i2cSoftStop, i2cSoftWrite, i2cSoftRead} {
+		/* LJMP */
+		write(h.patchCallAddrs[5]+codeI2CTransferStubs+8*i, 0x02, byte((blob+m)>>8), byte(blob+m))
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to configure bit-banged I2C: %w", err)
+	}
+	return nil
+}
+
+/* I2CSetSpeed changes the speed of the bit-banged I2C bus. This only works when the HAL was
+ * created with HALConfig.I2CSpeed set, as the bit-banged functions are part of the patch. */
+func (h *HAL) I2CSetSpeed(speed int) error {
+	if h.config.I2CSpeed == 0 || !h.patchInstalled {
+		return errors.New("I2C speed can only be changed when bit-banging, set HALConfig.I2CSpeed")
+	}
+	if speed <= 0 {
+		return errors.New("I2C speed must be positive")
+	}
+
+	h.config.I2CSpeed = speed
+	return h.patchI2CSoftConfigure()
+}
@@ -0,0 +1,166 @@
+package mshal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+/* fakeI2CBus has a 24C32 EEPROM at 0x50 and a device at 0x20 that takes a register number and
+ * one value */
+type fakeI2CBus struct {
+	eeprom [4096]byte
+	regs   [256]byte
+
+	addressed bool /* The next byte is the address */
+	addr      uint8
+	written   int
+	ptr       int
+
+	/* Transactions as the address byte followed by the number of bytes written */
+	log [][2]int
+}
+
+func (b *fakeI2CBus) start() {
+	b.addressed = true
+}
+
+func (b *fakeI2CBus) stop() {
+	if b.addr != 0 {
+		b.log = append(b.log, [2]int{int(b.addr), b.written})
+	}
+	b.addr = 0
+}
+
+func (b *fakeI2CBus) write(value byte) bool {
+	if b.addressed {
+		b.stop()
+		b.addressed = false
+		b.addr, b.written = value, 0
+		if value>>1 != 0x50 && value>>1 != 0x20 {
+			b.addr = 0
+		}
+		return b.addr != 0
+	}
+
+	if b.addr == 0 {
+		return false
+	}
+	b.written++
+
+	if b.addr>>1 == 0x50 {
+		switch b.written {
+		case 1:
+			b.ptr = int(value) << 8
+		case 2:
+			b.ptr |= int(value)
+		default:
+			b.eeprom[b.ptr%len(b.eeprom)] = value
+			b.ptr++
+		}
+		return true
+	}
+
+	switch b.written {
+	case 1:
+		b.ptr = int(value)
+	case 2:
+		b.regs[b.ptr] = value
+	default:
+		return false
+	}
+	return true
+}
+
+func (b *fakeI2CBus) read(ack bool) byte {
+	defer func() { b.ptr++ }()
+	if b.addr>>1 == 0x50 {
+		return b.eeprom[b.ptr%len(b.eeprom)]
+	}
+	return b.regs[b.ptr&0xff]
+}
+
+func newFakeI2CHAL(t *testing.T) (*HAL, *fakeMS2109) {
+	d := newFakeMS2109()
+	h := newFakeHAL(t, d, HALConfig{})
+	d.bus = &fakeI2CBus{}
+	t.Cleanup(func() {
+		if d.err != nil {
+			t.Errorf("blob: %v", d.err)
+		}
+	})
+	return h, d
+}
+
+func TestI2CProbeQuick(t *testing.T) {
+	h, d := newFakeI2CHAL(t)
+
+	for _, m := range []struct {
+		addr  uint8
+		found bool
+	}{{0x20, true}, {0x21, false}} {
+		d.exchanges = 0
+		found, err := h.I2CProbe(m.addr, I2CProbeQuick)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != m.found {
+			t.Errorf("%02x: found %v", m.addr, found)
+		}
+		if d.exchanges != 1 {
+			t.Errorf("%02x: %d exchanges, expected 1", m.addr, d.exchanges)
+		}
+	}
+
+	if len(d.bus.log) != 1 || d.bus.log[0] != [2]int{0x40, 0} {
+		t.Errorf("expected only the address, bus saw %v", d.bus.log)
+	}
+}
+
+func TestI2CTransferBatch(t *testing.T) {
+	h, d := newFakeI2CHAL(t)
+
+	if err := h.I2CWriteReg8(0x20, 0x12, 0x34); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := h.I2CReadReg8(0x20, 0x12); err != nil || value != 0x34 {
+		t.Errorf("read %02x, %v", value, err)
+	}
+
+	var nack *I2CNackError
+	err := h.I2CTransferMessages([]I2CMessage{{Addr: 0x20, Data: []byte{1, 2, 3}}}, false)
+	if !errors.As(err, &nack) || nack.Byte != 2 {
+		t.Errorf("expected no ACK for byte 2, got %v", err)
+	}
+
+	/* A page write and a read of the most one transfer takes */
+	page := []byte{0x01, 0x00}
+	for i := 0; i < 16; i++ {
+		page = append(page, byte(0xa0+i))
+	}
+	d.exchanges = 0
+	if ok, err := h.I2CTransfer(0x50, page, nil); !ok || err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if d.exchanges != 7 {
+		t.Errorf("write took %d exchanges, expected 7", d.exchanges)
+	}
+	if !bytes.Equal(d.bus.eeprom[0x100:0x110], page[2:]) {
+		t.Errorf("EEPROM holds %x", d.bus.eeprom[0x100:0x110])
+	}
+
+	for i := range d.bus.eeprom {
+		d.bus.eeprom[i] = byte(i * 7)
+	}
+	buf := make([]byte, i2cTransferBatchMax-2)
+	d.exchanges = 0
+	if ok, err := h.I2CTransfer(0x50, []byte{0x02, 0x10}, buf); !ok || err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if d.exchanges != 10 {
+		t.Errorf("read took %d exchanges, expected 10", d.exchanges)
+	}
+	if !bytes.Equal(buf, d.bus.eeprom[0x210:0x210+len(buf)]) {
+		t.Errorf("read %x", buf)
+	}
+}
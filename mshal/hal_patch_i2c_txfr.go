@@ -0,0 +1,148 @@
+package mshal
+
+import (
+	_ "embed"
+	"encoding/binary"
+
+	"github.com/johnneerdael/ms-tools/mshal/mseeprom"
+)
+
+//go:embed asm/i2c_txfr.bin
+var codeI2CTransfer []byte
+
+/* Offsets of the addresses in i2c_txfr.bin that point into the blob itself */
+var codeI2CTransferRelocs = []int{30, 38, 53, 68, 78, 92, 105, 166, 173}
+
+/* Entry points besides the transfer at the start of the blob */
+const (
+	codeI2CTransferLoad  = 2
+	codeI2CTransferStore = 4
+)
+
+const codeI2CTransferStubs = 196
+
+/* Each stub calls one ROM function, it gets the argument in R7 and returns the ACK in C */
+func (p *patchProfile) i2cTransferStubs() [][]byte {
+	ljmp := func(addr int) []byte {
+		return []byte{0x02, byte(addr >> 8), byte(addr)}
+	}
+
+	/* MOV A, R7 */
+	start := append([]byte{0xef}, ljmp(p.i2cStart)...)
+	stop := append([]byte{0xef}, ljmp(p.i2cStop)...)
+
+	write := append([]byte{0xef}, ljmp(p.i2cWrite)...)
+	if p.i2cWriteAckR7 {
+		/* LCALL i2cWrite, MOV A, R7, ADD A, #0xFF, RET */
+		write = []byte{0xef, 0x12, byte(p.i2cWrite >> 8), byte(p.i2cWrite), 0xef, 0x24, 0xff, 0x22}
+	}
+
+	read := []byte{0xef}
+	if p.i2cReadAckBit != 0 {
+		/* MOV bit, C */
+		read = append(read, 0x92, byte(p.i2cReadAckBit))
+	}
+	read = append(read, ljmp(p.i2cRead)...)
+
+	return [][]byte{start, stop, write, read}
+}
+
+func relocateI2CTransfer(p *patchProfile) func([]byte, int) (int, []byte) {
+	return func(result []byte, addr int) (int, []byte) {
+		for _, m := range codeI2CTransferRelocs {
+			if result[m-1] != 0x12 && result[m-1] != 0x90 {
+				panic("Offset is not LCALL or MOV DPTR")
+			}
+
+			target := binary.BigEndian.Uint16(result[m:])
+			binary.BigEndian.PutUint16(result[m:], target+uint16(addr))
+		}
+
+		for i, m := range p.i2cTransferStubs() {
+			copy(result[codeI2CTransferStubs+8*i:], m)
+		}
+
+		return addr, result
+	}
+}
+
+/* Maximum number of bytes in a batched transfer. The buffer is at the end of USERRAM, patchAlloc
+ * stops before it and user code that reaches into it is refused by patchInitAlloc. */
+const i2cTransferBatchMax = mseeprom.TransferBufferLen
+
+func (h *HAL) patchI2CTransferBuffer() (MemoryRegion, int) {
+	region := h.MemoryRegionGet(MemoryRegionUserRAM)
+	parent, addr := region.GetParent()
+	return parent, addr + region.GetLength() - i2cTransferBatchMax
+}
+
+func patchI2CTransferResult(resp PatchExecFuncResponse) []byte {
+	return []byte{resp.R2, resp.R3, resp.R4, resp.R5, resp.R6, resp.R7, resp.A}
+}
+
+/* patchI2CTransferBatch performs the transfer on the chip. It returns 0 if all bytes were
+ * acknowledged, otherwise which byte was not (see i2c_txfr.asm). The write data is stored 3 bytes
+ * per exchange and read data comes back 7 bytes per exchange, the most a feature report carries. */
+func (h *HAL) patchI2CTransferBatch(addr uint8, wrBuf []byte, rdBuf []byte) (int, error) {
+	ram, bufAddr := h.patchI2CTransferBuffer()
+
+	/* Whole calls are cheaper than single bytes, the padding lands where read data goes */
+	staged := wrBuf
+	if pad := (3 - len(wrBuf)%3) % 3; len(wrBuf)+pad <= i2cTransferBatchMax {
+		staged = append(append([]byte{}, wrBuf...), make([]byte, pad)...)
+	}
+	if err := h.patchWriteBuffer(ram, bufAddr, staged); err != nil {
+		return 0, err
+	}
+
+	blob := h.patchCallAddrs[5]
+	resp, err := h.PatchExecFunc(true, blob, PatchExecFuncRequest{
+		DPTR: uint16(bufAddr),
+		R5:   addr << 1,
+		R6:   byte(len(wrBuf)),
+		R7_A: byte(len(rdBuf)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !resp.C {
+		return int(resp.R7), nil
+	}
+
+	/* The first bytes are returned directly, fetch the rest from the buffer */
+	n := copy(rdBuf, patchI2CTransferResult(resp))
+	return 0, h.patchReadBuffer(bufAddr+len(wrBuf)+n, rdBuf[n:])
+}
+
+/* patchWriteBuffer fills XDATA 3 bytes per call through the store entry of the transfer blob, the
+ * rest is written through RAM so nothing is stored behind buf */
+func (h *HAL) patchWriteBuffer(ram MemoryRegion, addr int, buf []byte) error {
+	for len(buf) >= 3 {
+		_, err := h.PatchExecFunc(true, h.patchCallAddrs[5]+codeI2CTransferStore, PatchExecFuncRequest{
+			DPTR: uint16(addr),
+			R5:   buf[0],
+			R6:   buf[1],
+			R7_A: buf[2],
+		})
+		if err != nil {
+			return err
+		}
+		addr += 3
+		buf = buf[3:]
+	}
+
+	_, err := ram.Access(true, addr, buf)
+	return err
+}
+
+/* patchReadBuffer reads XDATA 7 bytes at a time through the load entry of the transfer blob */
+func (h *HAL) patchReadBuffer(addr int, buf []byte) error {
+	for n := 0; n < len(buf); {
+		resp, err := h.PatchExecFunc(true, h.patchCallAddrs[5]+codeI2CTransferLoad, PatchExecFuncRequest{DPTR: uint16(addr + n)})
+		if err != nil {
+			return err
+		}
+		n += copy(buf[n:], patchI2CTransferResult(resp))
+	}
+	return nil
+}
@@ -6,17 +6,30 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"time"
+
+	"github.com/johnneerdael/ms-tools/mshal/mseeprom"
 )
 
-func (h *HAL) patchAlloc(len int) int {
+/* patchAllocLimit returns the end of the space for the patch, the I2C transfer buffer lives behind it */
+func (h *HAL) patchAllocLimit() int {
+	_, addr := h.patchI2CTransferBuffer()
+	return addr
+}
+
+func (h *HAL) patchAlloc(len int) (int, error) {
 	addr := h.patchAllocAddr
+	if addr+len > h.patchAllocLimit() {
+		return 0, fmt.Errorf("patch needs %d bytes at %04x, only %d are free before the I2C buffer", len, addr, h.patchAllocLimit()-addr)
+	}
+
 	h.patchAllocAddr += len
 	if h.config.LogFunc != nil {
 		h.config.LogFunc(2, "Allocated %d bytes for patch at %04x", len, addr)
 	}
-	return addr
+	return addr, nil
 }
 
 func (h *HAL) patchWriteWithTempFirstByte(region MemoryRegion, addr int, data []byte, firstByte byte) error {
@@ -72,10 +85,20 @@ func patchTrampolineEncode(orig []byte, origAddr int, R0Value byte, hookAddr int
 	return result
 }
 
+func patchTrampolineReplaceLen(in []byte) int {
+	if in[0] == 0x2 || in[0] == 0x12 || in[0] == 0x90 {
+		return 3
+	} else if in[0] == 0xe5 && in[1] == 0x33 && in[2] == 0x30 {
+		return 14
+	}
+
+	return 0
+}
+
 func (h *HAL) patchTrampolineInstall(ram MemoryRegion, replaceCode bool, origAddr int, addr int, R0value byte, hookAddr int) error {
 	var trampoline []byte
 	if replaceCode {
-		replaceLen := 0
+		var replaceLen int
 		var in [14]byte
 
 		_, err := ram.Access(false, addr, in[:])
@@ -84,11 +107,7 @@ func (h *HAL) patchTrampolineInstall(ram MemoryRegion, replaceCode bool, origAdd
 		}
 
 		/* Can we patch this code? */
-		if in[0] == 0x2 || in[0] == 0x12 || in[0] == 0x90 {
-			replaceLen = 3
-		} else if in[0] == 0xe5 && in[1] == 0x33 && in[2] == 0x30 {
-			replaceLen = 14
-		} else {
+		if replaceLen = patchTrampolineReplaceLen(in[:]); replaceLen == 0 {
 			return ErrorPatchFailed
 		}
 
@@ -97,7 +116,10 @@ func (h *HAL) patchTrampolineInstall(ram MemoryRegion, replaceCode bool, origAdd
 		trampoline = patchTrampolineEncode(nil, origAddr, R0value, hookAddr)
 	}
 
-	trampolineAddr := h.patchAlloc(len(trampoline))
+	trampolineAddr, err := h.patchAlloc(len(trampoline))
+	if err != nil {
+		return err
+	}
 
 	if h.config.LogFunc != nil {
 		h.config.LogFunc(2, "Writing trampoline at %04x: %s", trampolineAddr, hex.EncodeToString(trampoline))
@@ -161,6 +183,12 @@ var installBlobs2106 = []CodeBlob{
 		Data: codeMOVC,
 	}, {
 		Data: codeUartTX,
+	}, {
+		Data:     codeI2CTransfer,
+		Relocate: relocateI2CTransfer(&patchProfile2106),
+	}, {
+		Data:     codeSPI,
+		Relocate: relocateSPI,
 	}}
 
 var installBlobs2107 = []CodeBlob{
@@ -175,6 +203,12 @@ var installBlobs2107 = []CodeBlob{
 		Data: codei2cRead2107,
 	}, {
 		Data: codeUartTX,
+	}, {
+		Data:     codeI2CTransfer,
+		Relocate: relocateI2CTransfer(&patchProfile2107),
+	}, {
+		Data:     codeSPI,
+		Relocate: relocateSPI,
 	}}
 
 var installBlobs2109 = []CodeBlob{
@@ -189,6 +223,12 @@ var installBlobs2109 = []CodeBlob{
 		Data: codei2cRead2109,
 	}, {
 		Data: codeUartTX,
+	}, {
+		Data:     codeI2CTransfer,
+		Relocate: relocateI2CTransfer(&patchProfile2109),
+	}, {
+		Data:     codeSPI,
+		Relocate: relocateSPI,
 	}}
 
 func (h *HAL) EEPROMReloadUser() error {
@@ -199,19 +239,17 @@ func (h *HAL) EEPROMReloadUser() error {
 	ram := h.MemoryRegionGet(MemoryRegionRAM)
 	userConfig := h.MemoryRegionGet(MemoryRegionUserConfig)
 
+	profile := h.patchProfileGet()
+	if profile == nil {
+		return ErrorUnknownDevice
+	}
+
 	doInIRQ := true
-	var loadEEPROM []byte
-	if h.deviceType == 2106 {
-		loadEEPROM = []byte{0x02, 0x12, 0x82}
-	} else if h.deviceType == 2107 {
+	if h.deviceType == 2107 {
 		doInIRQ = false
-		loadEEPROM = []byte{0x02, 0x66, 0x56}
 		defer time.Sleep(125 * time.Millisecond)
-	} else if h.deviceType == 2109 {
-		loadEEPROM = []byte{0x02, 0x5f, 0x19}
-	} else {
-		return ErrorUnknownDevice
 	}
+	loadEEPROM := []byte{0x02, byte(profile.eepromLoad >> 8), byte(profile.eepromLoad)}
 
 	/* Write RET and disable callback */
 	addr, _, err := h.patchHookGet(userConfig, doInIRQ)
@@ -255,129 +293,85 @@ func (h *HAL) EEPROMIsLoaded() (bool, int, error) {
 		return false, 0, err
 	}
 
-	eepromLen := int(binary.BigEndian.Uint16(hdr[2:]))
+	return h.eepromHeaderParse(hdr[:])
+}
 
-	if h.deviceType == 2106 {
-		return hdr[0] == 0x5a && hdr[1] == 0xa5, eepromLen, nil
-	} else if h.deviceType == 2107 {
-		if hdr[0] == 0x08 && hdr[1] == 0x16 {
-			return true, eepromLen, nil
-		}
-		return hdr[0] == 0x32 && hdr[1] == 0x64, eepromLen, nil
-	} else if h.deviceType == 2109 {
-		if hdr[0] == 0xa5 && hdr[1] == 0x5a {
-			return true, eepromLen, nil
-		}
-		return hdr[0] == 0x96 && hdr[1] == 0x69, eepromLen, nil
+func (h *HAL) eepromHeaderParse(hdr []byte) (bool, int, error) {
+	if h.deviceType != 2106 && h.deviceType != 2107 && h.deviceType != 2109 {
+		return false, 0, ErrorUnknownDevice
 	}
 
-	return false, 0, ErrorUnknownDevice
+	chip := mseeprom.ChipFromMagic(binary.BigEndian.Uint16(hdr))
+	return int(chip) == h.deviceType, int(binary.BigEndian.Uint16(hdr[2:])), nil
 }
 
+/* The hook sites and flags are defined by mseeprom, loc is the USERCONFIG region holding the header */
 func (h *HAL) patchHookGet(loc MemoryRegion, inIRQ bool) (int, bool, error) {
-	if h.deviceType == 2106 {
-		if inIRQ {
-			value, err := ReadByte(loc, 0x9)
-			return 0xc4a0, value == 0x96, err
-		} else {
-			value, err := ReadByte(loc, 0x5)
-			return 0xc420, value == 0x5a, err
-		}
-	} else if h.deviceType == 2107 {
-		value, err := ReadByte(loc, 0x8)
-		if inIRQ {
-			return 0xc810, value&2 > 0, err
-		} else {
-			return 0xc800, value&1 > 0, err
-		}
-	} else if h.deviceType == 2109 {
-		value, err := ReadByte(loc, 0x4)
-		if inIRQ {
-			return 0xcc20, value&4 > 0, err
-		} else {
-			return 0xcc00, value&1 > 0, err
-		}
+	chip := mseeprom.Chip(h.deviceType)
+	index := chip.HookFlagOffset(inIRQ)
+	if index < 0 {
+		return 0, false, ErrorUnknownDevice
+	}
+
+	hdr := make([]byte, index+1)
+	if _, err := loc.Access(false, 0, hdr); err != nil {
+		return 0, false, err
 	}
 
-	return 0, false, ErrorUnknownDevice
+	return chip.HookAddr(inIRQ), chip.HookEnabled(hdr, inIRQ), nil
 }
+
 func (h *HAL) patchHookSet(loc MemoryRegion, inIRQ bool, enable bool) error {
 	if h.config.LogFunc != nil {
 		h.config.LogFunc(2, "Configuring userhook: inIRQ=%v, enable=%v", inIRQ, enable)
 	}
 
-	if h.deviceType == 2106 {
-		value := byte(0)
-		if inIRQ {
-			if enable {
-				value = 0x96
-			}
-			return WriteByte(loc, 0x9, value)
-		} else {
-			if enable {
-				value = 0x5a
-			}
-			return WriteByte(loc, 0x5, value)
-		}
-	} else if h.deviceType == 2107 {
-		value, err := ReadByte(loc, 0x8)
-		if err != nil {
-			return err
-		}
-
-		if inIRQ {
-			value &= ^byte(2)
-			if enable {
-				value |= 2
-			}
-		} else {
-			value &= ^byte(1)
-			if enable {
-				value |= 1
-			}
-		}
-
-		return WriteByte(loc, 0x8, value)
-	} else if h.deviceType == 2109 {
-		value, err := ReadByte(loc, 0x4)
-		if err != nil {
-			return err
-		}
-
-		if inIRQ {
-			value &= ^byte(4)
-			if enable {
-				value |= 4
-			}
-		} else {
-			value &= ^byte(1)
-			if enable {
-				value |= 1
-			}
-		}
+	chip := mseeprom.Chip(h.deviceType)
+	index := chip.HookFlagOffset(inIRQ)
+	if index < 0 {
+		return ErrorUnknownDevice
+	}
 
-		return WriteByte(loc, 0x4, value)
+	hdr := make([]byte, index+1)
+	if _, err := loc.Access(false, 0, hdr); err != nil {
+		return err
 	}
 
-	return ErrorUnknownDevice
+	chip.SetHook(hdr, inIRQ, enable)
+	return WriteByte(loc, index, hdr[index])
 }
 
-func (h *HAL) patchInitAlloc(userConfig MemoryRegion) (bool, error) {
+/* patchAllocStart returns where the patch starts, behind the user code or the space reserved for it */
+func (h *HAL) patchAllocStart(userConfig MemoryRegion) (bool, int, error) {
 	userCodePresent, userCodeLen, err := h.EEPROMIsLoaded()
 	if err != nil {
-		return userCodePresent, err
+		return userCodePresent, 0, err
 	}
 	if !userCodePresent {
 		userCodeLen = 256
 	}
 	_, userOffset := RecursiveGetParentAddress(userConfig, userConfig.GetLength())
 
-	h.patchAllocAddr = userOffset + userCodeLen
+	return userCodePresent, userOffset + userCodeLen, nil
+}
+
+func (h *HAL) patchInitAlloc(userConfig MemoryRegion) (bool, error) {
+	userCodePresent, start, err := h.patchAllocStart(userConfig)
+	if err != nil {
+		return userCodePresent, err
+	}
+
+	/* The I2C transfer blob would overwrite user code that reaches into its buffer */
+	if start > h.patchAllocLimit() {
+		return userCodePresent, fmt.Errorf("user code ends at %04x, behind the I2C transfer buffer at %04x", start, h.patchAllocLimit())
+	}
+
+	h.patchAllocAddr = start
 
 	return userCodePresent, nil
 }
 
-func (h *HAL) patchInstall() (bool, error) {
+func (h *HAL) patchBlobsGet() ([]CodeBlob, error) {
 	var installBlobs []CodeBlob
 	if h.deviceType == 2109 {
 		installBlobs = installBlobs2109
@@ -386,17 +380,21 @@ func (h *HAL) patchInstall() (bool, error) {
 	} else if h.deviceType == 2106 {
 		installBlobs = installBlobs2106
 	} else {
-		return false, errors.New("this device does not support runtime patching")
+		return nil, errors.New("this device does not support runtime patching")
 	}
 
-	h.patchCallAddrsExternalStart = len(installBlobs)
-	installBlobs = append(installBlobs, h.config.PatchBlobs...)
-
-	ram := h.MemoryRegionGet(MemoryRegionRAM)
-	userConfig := h.MemoryRegionGet(MemoryRegionUserConfig)
+	if h.config.I2CSpeed > 0 {
+		installBlobs = append(installBlobs, CodeBlob{
+			Data:     codeI2CSoft,
+			Relocate: relocateI2CSoft,
+		})
+	}
 
-	h.patchCallAddrs = make([]int, len(installBlobs))
+	h.patchCallAddrsExternalStart = len(installBlobs)
+	return append(installBlobs, h.config.PatchBlobs...), nil
+}
 
+func (h *HAL) patchChecksum(installBlobs []CodeBlob) []byte {
 	/* Calculate checksum of blobs */
 	crc := crc32.New(crc32.IEEETable)
 	for _, m := range installBlobs {
@@ -408,54 +406,61 @@ func (h *HAL) patchInstall() (bool, error) {
 		sum[0] = ^sum[0]
 	}
 
-	if _, err := h.patchInitAlloc(userConfig); err != nil {
-		return false, err
-	}
+	return sum
+}
 
-	/* Read current stored patch info */
-	sumBlock := make([]byte, len(sum)+2*len(installBlobs))
-	sumBlockAddr := h.patchAlloc(len(sumBlock))
+/* patchFind returns the blob addresses of the running patch with the given checksum, or nil if it is not running */
+func (h *HAL) patchFind(installBlobs []CodeBlob, sum []byte) ([]int, error) {
+	ram := h.MemoryRegionGet(MemoryRegionRAM)
+	userConfig := h.MemoryRegionGet(MemoryRegionUserConfig)
 
-	if _, err := ram.Access(false, sumBlockAddr, sumBlock); err != nil {
-		return false, err
+	_, sumBlockAddr, err := h.patchAllocStart(userConfig)
+	if err != nil {
+		return nil, err
 	}
 
-	/* Is this chip already patched? */
-	if bytes.Equal(sumBlock[:4], sum) {
-		sumBlock = sumBlock[4:]
-		for i := range installBlobs {
-			h.patchCallAddrs[i] = int(binary.BigEndian.Uint16(sumBlock))
-			sumBlock = sumBlock[2:]
-		}
-		return false, nil
-	}
+	/* Read current stored patch info. It is stored behind the user code, or at the end of it
+	 * if the patch was persisted to the EEPROM */
+	sumBlock := make([]byte, len(sum)+2*len(installBlobs))
 
-	if !h.config.PatchIgnoreUserFirmware {
-		/* Reload eeprom to unpatch */
-		if err := h.EEPROMReloadUser(); err != nil {
-			return true, err
+	for _, addr := range []int{sumBlockAddr, sumBlockAddr - len(sumBlock)} {
+		if _, err := ram.Access(false, addr, sumBlock); err != nil {
+			return nil, err
 		}
-	} else {
-		/* Remove EEPROM data */
-		if err := h.EEPROMIgnoreUser(); err != nil {
-			return false, err
+
+		if bytes.Equal(sumBlock[:4], sum) {
+			callAddrs := make([]int, len(installBlobs))
+			for i := range installBlobs {
+				callAddrs[i] = int(binary.BigEndian.Uint16(sumBlock[4+(2*i):]))
+			}
+			return callAddrs, nil
 		}
 	}
 
-	userCodePresent, err := h.patchInitAlloc(userConfig)
-	if err != nil {
+	return nil, nil
+}
+
+/* Checks if the patch with the given checksum is running and loads the blob addresses if it is */
+func (h *HAL) patchDetect(installBlobs []CodeBlob, sum []byte) (bool, error) {
+	callAddrs, err := h.patchFind(installBlobs, sum)
+	if err != nil || callAddrs == nil {
 		return false, err
 	}
 
-	sumBlock = make([]byte, len(sum)+2*len(installBlobs))
-	sumBlockAddr = h.patchAlloc(len(sumBlock))
-	copy(sumBlock, sum)
+	h.patchCallAddrs = callAddrs
+	return true, nil
+}
+
+func (h *HAL) patchWriteBlobs(ram MemoryRegion, installBlobs []CodeBlob) ([]int, error) {
+	callAddrs := make([]int, len(installBlobs))
 
-	/* Install all blobs */
 	for i, m := range installBlobs {
 		data := m.Data
 
-		loadAddr := h.patchAlloc(len(data))
+		loadAddr, err := h.patchAlloc(len(data))
+		if err != nil {
+			return nil, err
+		}
 		callAddr := loadAddr
 
 		if m.Relocate != nil {
@@ -468,12 +473,76 @@ func (h *HAL) patchInstall() (bool, error) {
 			h.config.LogFunc(2, "Writing blob at %04x: %s", loadAddr, hex.EncodeToString(data))
 		}
 
-		_, err := ram.Access(true, loadAddr, data)
-		if err != nil {
+		if _, err := ram.Access(true, loadAddr, data); err != nil {
+			return nil, err
+		}
+
+		callAddrs[i] = callAddr
+	}
+
+	return callAddrs, nil
+}
+
+func (h *HAL) patchInstall() (bool, error) {
+	installBlobs, err := h.patchBlobsGet()
+	if err != nil {
+		return false, err
+	}
+
+	ram := h.MemoryRegionGet(MemoryRegionRAM)
+	userConfig := h.MemoryRegionGet(MemoryRegionUserConfig)
+
+	sum := h.patchChecksum(installBlobs)
+
+	/* Is this chip already patched? */
+	if installed, err := h.patchDetect(installBlobs, sum); err != nil {
+		return false, err
+	} else if installed {
+		return false, nil
+	}
+
+	/* Make sure we understand the running firmware before touching it */
+	report, err := h.PatchPreflight()
+	if err != nil {
+		return false, err
+	}
+	if !report.OK() {
+		if h.config.LogFunc != nil {
+			h.config.LogFunc(1, "%s", report)
+		}
+		return false, ErrorPreflightFailed
+	}
+	if h.config.LogFunc != nil {
+		h.config.LogFunc(2, "%s", report)
+	}
+
+	if !h.config.PatchIgnoreUserFirmware {
+		/* Reload eeprom to unpatch */
+		if err := h.EEPROMReloadUser(); err != nil {
 			return true, err
 		}
+	} else {
+		/* Remove EEPROM data */
+		if err := h.EEPROMIgnoreUser(); err != nil {
+			return false, err
+		}
+	}
+
+	userCodePresent, err := h.patchInitAlloc(userConfig)
+	if err != nil {
+		return false, err
+	}
+
+	sumBlock := make([]byte, len(sum)+2*len(installBlobs))
+	sumBlockAddr, err := h.patchAlloc(len(sumBlock))
+	if err != nil {
+		return false, err
+	}
+	copy(sumBlock, sum)
 
-		h.patchCallAddrs[i] = callAddr
+	/* Install all blobs */
+	if h.patchCallAddrs, err = h.patchWriteBlobs(ram, installBlobs); err != nil {
+		return true, err
 	}
 
 	/* Check current state */
@@ -494,10 +563,8 @@ func (h *HAL) patchInstall() (bool, error) {
 	} else {
 		enableIrq = true
 		enableNorm = true
-		if h.deviceType == 2107 {
-			/* If the USB IRQ patch is enabled it must call the original handler (or do everything itself) */
-			nextAddr = 0x54ae
-		}
+		/* If the USB IRQ patch is enabled it must call the original handler (or do everything itself) */
+		nextAddr = h.patchProfileGet().usbIRQ
 	}
 
 	if h.deviceType == 2107 {
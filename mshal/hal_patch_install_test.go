@@ -0,0 +1,194 @@
+package mshal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+/* fakeMS2109 answers the ROM protocol of an MS2109 that loaded user firmware from its EEPROM. Calls
+ * to the MOVC blob return CODE, and enabling the IRQ hook while it jumps to the ROM EEPROM loader
+ * loads the EEPROM again, like the ROM does. */
+type fakeMS2109 struct {
+	xdata  [0x10000]byte
+	code   [0x10000]byte
+	eeprom []byte
+	resp   [9]byte
+
+	/* With a bus other calls run the blob, the ROM I2C functions drive the bus */
+	bus *fakeI2CBus
+	err error
+
+	exchanges int
+}
+
+const (
+	fakeUserConfig = 0xcbd0
+	fakeCodeLen    = 0x40
+)
+
+func newFakeMS2109() *fakeMS2109 {
+	d := &fakeMS2109{}
+	d.xdata[0xf800] = 0xa7
+
+	/* Header enabling both hooks, followed by code with an LJMP at each hook site */
+	d.eeprom = bytes.Repeat([]byte{0xff}, 2048)
+	hdr := d.eeprom[:0x30]
+	for i := range hdr {
+		hdr[i] = 0
+	}
+	binary.BigEndian.PutUint16(hdr, 0xa55a)
+	binary.BigEndian.PutUint16(hdr[2:], fakeCodeLen)
+	hdr[4] = 0x05
+	code := d.eeprom[0x30 : 0x30+fakeCodeLen]
+	for i := range code {
+		code[i] = 0x22
+	}
+	copy(code, []byte{0x02, 0xcc, 0x10})
+	copy(code[0x20:], []byte{0x02, 0xcc, 0x30})
+	d.loadEEPROM()
+
+	/* ROM I2C functions on SCL=P0.0, SDA=P0.1 */
+	p := &patchProfile2109
+	copy(d.code[p.i2cStart:], []byte{0xc2, 0x81, 0xc2, 0x80, 0x22})
+	copy(d.code[p.i2cStop:], []byte{0xd2, 0x80, 0xd2, 0x81, 0x22})
+	copy(d.code[p.i2cWrite:], []byte{0x92, 0x81, 0xa2, 0x81, 0x22})
+	copy(d.code[p.i2cRead:], []byte{0xa2, 0x81, 0xa2, byte(p.i2cReadAckBit), 0x22})
+	d.code[p.eepromLoad] = 0x22
+
+	return d
+}
+
+func (d *fakeMS2109) loadEEPROM() {
+	copy(d.xdata[fakeUserConfig:], d.eeprom[:0x30+fakeCodeLen])
+}
+
+func (d *fakeMS2109) SendFeatureReport(b []byte) (int, error) {
+	d.exchanges++
+	copy(d.resp[:], b)
+	addr := int(binary.BigEndian.Uint16(b[2:]))
+
+	switch b[1] {
+	case 0xb5:
+		d.resp[4] = d.xdata[addr]
+	case 0xb6:
+		d.xdata[addr] = b[4]
+
+		irqHook := d.xdata[0xcc20:0xcc23]
+		load := []byte{0x02, byte(patchProfile2109.eepromLoad >> 8), byte(patchProfile2109.eepromLoad)}
+		if d.xdata[fakeUserConfig+4]&4 != 0 && bytes.Equal(irqHook, load) {
+			d.loadEEPROM()
+		}
+	case 0xe5:
+		copy(d.resp[4:], d.eeprom[addr:addr+5])
+	case 0xee, 0xef:
+		d.resp[1] = 0xff
+		if bytes.Equal(d.xdata[addr:addr+len(codeMOVC)], codeMOVC) {
+			d.resp[2] = d.code[binary.BigEndian.Uint16(b[4:])]
+		} else if d.bus != nil {
+			d.call(addr, b)
+		}
+	}
+
+	return len(b), nil
+}
+
+/* call sets up the registers like hookWork in hook.asm and returns them like hookRun */
+func (d *fakeMS2109) call(addr int, b []byte) {
+	cpu := &i8051{
+		xdata: &d.xdata,
+		rom:   d.rom,
+		a:     b[8],
+		c:     b[8]&1 != 0,
+		dptr:  binary.BigEndian.Uint16(b[4:]),
+	}
+	copy(cpu.iram[3:], b[4:9])
+
+	if err := cpu.call(addr); err != nil && d.err == nil {
+		d.err = err
+	}
+
+	d.resp[1] = 0xfe
+	if cpu.c {
+		d.resp[1] |= 1
+	}
+	d.resp[2] = cpu.a
+	copy(d.resp[3:], cpu.iram[2:8])
+}
+
+/* rom does what the ROM I2C functions of the MS2109 do */
+func (d *fakeMS2109) rom(cpu *i8051, addr int) error {
+	p := &patchProfile2109
+	switch addr {
+	case p.i2cStart:
+		d.bus.start()
+	case p.i2cStop:
+		d.bus.stop()
+	case p.i2cWrite:
+		cpu.c = d.bus.write(cpu.iram[7])
+	case p.i2cRead:
+		cpu.iram[7] = d.bus.read(!cpu.bit(byte(p.i2cReadAckBit)))
+	default:
+		return fmt.Errorf("call to ROM %04x", addr)
+	}
+	return nil
+}
+
+func (d *fakeMS2109) GetFeatureReport(b []byte) (int, error) {
+	return copy(b, d.resp[:]), nil
+}
+
+func (d *fakeMS2109) Close() error {
+	return nil
+}
+
+func newFakeHAL(t *testing.T, d *fakeMS2109, config HALConfig) *HAL {
+	config.PatchTryInstall = true
+	config.LogFunc = func(level int, format string, param ...interface{}) {
+		t.Logf(format, param...)
+	}
+
+	h, err := New(d, config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return h
+}
+
+func TestPatchInstallUserFirmware(t *testing.T) {
+	d := newFakeMS2109()
+	newFakeHAL(t, d, HALConfig{})
+
+	hook := append([]byte{}, d.xdata[0xcc00:0xcc03]...)
+	if hook[0] != 0x02 || binary.BigEndian.Uint16(hook[1:]) < fakeUserConfig+0x30+fakeCodeLen {
+		t.Errorf("hook site does not jump to the patch: %x", hook)
+	}
+
+	/* The running patch is used as it is */
+	newFakeHAL(t, d, HALConfig{})
+	if !bytes.Equal(d.xdata[0xcc00:0xcc03], hook) {
+		t.Errorf("patch was installed again, hook site %x", d.xdata[0xcc00:0xcc03])
+	}
+}
+
+func TestPatchInstallI2CSoft(t *testing.T) {
+	d := newFakeMS2109()
+	h := newFakeHAL(t, d, HALConfig{I2CSpeed: 100000})
+
+	if h.i2cSoftSCL != 0x80 || h.i2cSoftSDA != 0x81 {
+		t.Errorf("pins SCL %02x, SDA %02x, expected 80 and 81", h.i2cSoftSCL, h.i2cSoftSDA)
+	}
+
+	installBlobs, err := h.patchBlobsGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callAddrs, err := h.patchFind(installBlobs, h.patchChecksum(installBlobs)); err != nil || callAddrs == nil {
+		t.Errorf("patch with bit-banged I2C is not running: %v", err)
+	}
+
+	/* The running patch is found again, and dropping bit-banging replaces it */
+	newFakeHAL(t, d, HALConfig{I2CSpeed: 400000})
+	newFakeHAL(t, d, HALConfig{})
+}
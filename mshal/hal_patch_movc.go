@@ -1,7 +1,7 @@
 package mshal
 
-func (h *HAL) patchReadCode(addr int) (byte, error) {
-	resp, err := h.PatchExecFunc(true, h.patchCallAddrs[2], PatchExecFuncRequest{DPTR: uint16(addr)})
+func (h *HAL) patchReadCode(movcAddr int, addr int) (byte, error) {
+	resp, err := h.patchExecFunc(true, movcAddr, PatchExecFuncRequest{DPTR: uint16(addr)})
 	if err != nil {
 		return 0, err
 	}
@@ -9,7 +9,8 @@ func (h *HAL) patchReadCode(addr int) (byte, error) {
 }
 
 type halPatchCodeMemoryRegion struct {
-	hal *HAL
+	hal      *HAL
+	movcAddr int /* Address of the MOVC blob */
 }
 
 func (h halPatchCodeMemoryRegion) GetName() MemoryRegionNameType {
@@ -37,7 +38,7 @@ func (h halPatchCodeMemoryRegion) Access(write bool, addr int, buf []byte) (int,
 		return 0, nil
 	}
 
-	value, err := h.hal.patchReadCode(addr)
+	value, err := h.hal.patchReadCode(h.movcAddr, addr)
 	if err != nil {
 		return 0, err
 	}
@@ -51,5 +52,5 @@ func (h *HAL) patchMakeCodeRegion() MemoryRegion {
 		return nil
 	}
 
-	return regionWrapCompleteIO(halPatchCodeMemoryRegion{hal: h})
+	return regionWrapCompleteIO(halPatchCodeMemoryRegion{hal: h, movcAddr: h.patchCallAddrs[2]})
 }
@@ -0,0 +1,122 @@
+package mshal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/johnneerdael/ms-tools/mshal/mseeprom"
+)
+
+/* PatchBuildEEPROM appends the patch blobs, trampolines and sumblock to the user firmware in the
+ * given EEPROM image. A device booting from the result has the patch installed immediately. */
+func (h *HAL) PatchBuildEEPROM(image []byte) ([]byte, error) {
+	if h.config.PatchIgnoreUserFirmware {
+		return nil, errors.New("can't persist patch while ignoring user firmware")
+	}
+
+	installBlobs, err := h.patchBlobsGet()
+	if err != nil {
+		return nil, err
+	}
+
+	userConfig := h.MemoryRegionGet(MemoryRegionUserConfig)
+	_, base := RecursiveGetParentAddress(userConfig, 0)
+	hdrLen := userConfig.GetLength()
+
+	if len(image) < hdrLen {
+		return nil, errors.New("image too short (hdr)")
+	}
+
+	present, codeLen, err := h.eepromHeaderParse(image)
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		return nil, errors.New("image does not contain user firmware")
+	}
+
+	codeEnd := hdrLen + codeLen
+	if len(image) < codeEnd {
+		return nil, errors.New("image too short (code)")
+	}
+
+	sum := h.patchChecksum(installBlobs)
+	sumBlock := make([]byte, len(sum)+2*len(installBlobs))
+	if codeLen >= len(sumBlock) && bytes.Equal(image[codeEnd-len(sumBlock):][:len(sum)], sum) {
+		return nil, errors.New("patch is already present in image")
+	}
+
+	/* Load the firmware in a copy of XDATA like the ROM does and install the patch there */
+	xdata := make([]byte, 0x10000)
+	copy(xdata[base:], image[:codeEnd])
+	ram := regionWrapBuffer(MemoryRegionRAM, xdata)
+	config := regionWrapPartial(MemoryRegionUserConfig, ram, base, hdrLen)
+
+	allocAddr := h.patchAllocAddr
+	defer func() {
+		h.patchAllocAddr = allocAddr
+	}()
+	h.patchAllocAddr = base + codeEnd
+
+	callAddrs, err := h.patchWriteBlobs(ram, installBlobs)
+	if err != nil {
+		return nil, err
+	}
+
+	addrIrq, enableIrq, err := h.patchHookGet(config, true)
+	if err != nil {
+		return nil, err
+	}
+	addrNorm, enableNorm, err := h.patchHookGet(config, false)
+	if err != nil {
+		return nil, err
+	}
+	if !enableIrq || !enableNorm {
+		return nil, ErrorPatchFailed
+	}
+
+	if err := h.patchTrampolineInstall(ram, true, 0, addrIrq, 0xee, callAddrs[0]); err != nil {
+		return nil, err
+	} else if err := h.patchTrampolineInstall(ram, true, 0, addrNorm, 0xef, callAddrs[0]); err != nil {
+		return nil, err
+	}
+
+	/* The sumblock goes last, so the HAL finds it at the end of the user code */
+	copy(sumBlock, sum)
+	for i := range installBlobs {
+		binary.BigEndian.PutUint16(sumBlock[4+(2*i):], uint16(callAddrs[i]))
+	}
+	sumBlockAddr, err := h.patchAlloc(len(sumBlock))
+	if err != nil {
+		return nil, err
+	}
+	copy(xdata[sumBlockAddr:], sumBlock)
+
+	end := h.patchAllocAddr
+
+	newCodeLen := end - base - hdrLen
+	binary.BigEndian.PutUint16(xdata[base+2:], uint16(newCodeLen))
+	result := append([]byte{}, xdata[base:end]...)
+
+	oldEnd := codeEnd
+	if mseeprom.HasChecksum(image, hdrLen, codeLen) {
+		oldEnd += 4
+
+		hdrSum, codeSum := mseeprom.Checksums(result, newCodeLen)
+		result = binary.BigEndian.AppendUint16(result, hdrSum)
+		result = binary.BigEndian.AppendUint16(result, codeSum)
+	}
+
+	/* Keep whatever follows the firmware, as long as we don't overwrite it */
+	if len(result) > len(image) {
+		return nil, errors.New("patched firmware does not fit in EEPROM")
+	}
+	for _, m := range image[oldEnd:len(result)] {
+		if m != 0xff {
+			return nil, errors.New("patched firmware would overwrite data following the user code")
+		}
+	}
+
+	return append(result, image[len(result):]...), nil
+}
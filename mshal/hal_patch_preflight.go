@@ -0,0 +1,262 @@
+package mshal
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type PreflightStatus int
+
+const (
+	PreflightPass PreflightStatus = iota
+	PreflightFail
+	PreflightSkipped
+)
+
+func (s PreflightStatus) String() string {
+	switch s {
+	case PreflightPass:
+		return "OK"
+	case PreflightFail:
+		return "FAIL"
+	}
+	return "SKIPPED"
+}
+
+type PreflightCheck struct {
+	Name   string
+	Addr   int
+	Data   []byte
+	Status PreflightStatus
+	Detail string
+}
+
+type PreflightReport struct {
+	Device string
+	Checks []PreflightCheck
+}
+
+func (r *PreflightReport) OK() bool {
+	for _, m := range r.Checks {
+		if m.Status == PreflightFail {
+			return false
+		}
+	}
+	return true
+}
+
+/* Skipped returns the number of checks that could not be done, they don't make the report fail */
+func (r *PreflightReport) Skipped() int {
+	n := 0
+	for _, m := range r.Checks {
+		if m.Status == PreflightSkipped {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *PreflightReport) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "Pre-flight checks for %s:\n", r.Device)
+	for _, m := range r.Checks {
+		fmt.Fprintf(&sb, "  %-18s %04x  %-7s %-28s %s\n", m.Name, m.Addr, m.Status, hex.EncodeToString(m.Data), m.Detail)
+	}
+	if n := r.Skipped(); n > 0 {
+		fmt.Fprintf(&sb, "%d checks skipped, the ROM functions the patch calls are not verified\n", n)
+	}
+
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func (r *PreflightReport) add(name string, addr int, data []byte, status PreflightStatus, format string, param ...interface{}) {
+	r.Checks = append(r.Checks, PreflightCheck{
+		Name:   name,
+		Addr:   addr,
+		Data:   data,
+		Status: status,
+		Detail: fmt.Sprintf(format, param...),
+	})
+}
+
+/* Maximum size of a trampoline, see patchTrampolineEncode */
+const patchTrampolineMaxLen = 9 + 14 + 3
+
+/* PatchPreflight verifies that the running firmware matches what the patch expects without writing anything.
+ * The ROM helpers are read from PatchROMImage, or via CODE if the patch is running already. */
+func (h *HAL) PatchPreflight() (*PreflightReport, error) {
+	installBlobs, err := h.patchBlobsGet()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PreflightReport{
+		Device: h.GetDeviceType(),
+	}
+
+	ram := h.MemoryRegionGet(MemoryRegionRAM)
+	userConfig := h.MemoryRegionGet(MemoryRegionUserConfig)
+
+	/* Blob addresses of a running patch, this must not change the state of the HAL */
+	callAddrs := h.patchCallAddrs
+	if !h.patchInstalled {
+		callAddrs, err = h.patchFind(installBlobs, h.patchChecksum(installBlobs))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	/* User firmware loaded from EEPROM */
+	var hdr [4]byte
+	if _, err := userConfig.Access(false, 0, hdr[:]); err != nil {
+		return nil, err
+	}
+	_, userConfigAddr := RecursiveGetParentAddress(userConfig, 0)
+
+	userCodePresent, userCodeLen, err := h.EEPROMIsLoaded()
+	if err != nil {
+		return nil, err
+	}
+	if h.config.PatchIgnoreUserFirmware {
+		report.add("User firmware", userConfigAddr, hdr[:], PreflightPass, "ignored")
+		userCodePresent = false
+	} else if userCodePresent {
+		report.add("User firmware", userConfigAddr, hdr[:], PreflightPass, "present, %d bytes", userCodeLen)
+	} else {
+		report.add("User firmware", userConfigAddr, hdr[:], PreflightPass, "not present")
+	}
+	if !userCodePresent {
+		userCodeLen = 256
+	}
+
+	/* Space for the sumblock, blobs and trampolines */
+	allocStart := userConfigAddr + userConfig.GetLength() + userCodeLen
+	allocEnd := allocStart + 4 + 2*len(installBlobs) + 2*patchTrampolineMaxLen
+	for _, m := range installBlobs {
+		allocEnd += len(m.Data)
+	}
+	allocLimit := h.patchAllocLimit()
+
+	/* Hook sites that will receive a trampoline. The user code in RAM is a copy of the EEPROM, so
+	 * anything else at the hook site was not put there by the user firmware. The EEPROM size is
+	 * not known before the patch is installed, the region only has to cover the user code. */
+	eeprom := h.MemoryRegionGet(MemoryRegionEEPROM)
+	if eeprom.GetLength() == 0 {
+		eeprom = h.memoryRegionEEPROMSized(userConfig.GetLength() + userCodeLen)
+	}
+	for _, inIRQ := range []bool{true, false} {
+		name := "Hook (main)"
+		if inIRQ {
+			name = "Hook (IRQ)"
+		}
+
+		addr, enabled, err := h.patchHookGet(userConfig, inIRQ)
+		if err != nil {
+			return nil, err
+		}
+
+		var in [14]byte
+		if _, err := ram.Access(false, addr, in[:]); err != nil {
+			return nil, err
+		}
+
+		if !userCodePresent {
+			report.add(name, addr, in[:3], PreflightPass, "not used by user firmware")
+			continue
+		} else if !enabled {
+			report.add(name, addr, in[:3], PreflightFail, "user firmware does not enable this hook")
+			continue
+		} else if callAddrs != nil {
+			report.add(name, addr, in[:3], PreflightPass, "trampoline of the running patch")
+			continue
+		} else if target := int(in[1])<<8 | int(in[2]); in[0] == 0x02 && target >= allocStart && target < allocLimit {
+			/* Patching reloads the user code before placing a trampoline */
+			report.add(name, addr, in[:3], PreflightPass, "trampoline of an earlier patch, replaced")
+			continue
+		}
+
+		replaceLen := patchTrampolineReplaceLen(in[:])
+		if replaceLen == 0 {
+			report.add(name, addr, in[:3], PreflightFail, "unsupported instruction at hook site")
+			continue
+		}
+
+		stored := make([]byte, replaceLen)
+		if _, err := eeprom.Access(false, addr-userConfigAddr, stored); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(in[:replaceLen], stored) {
+			report.add(name, addr, in[:replaceLen], PreflightFail, "differs from EEPROM: %s", hex.EncodeToString(stored))
+		} else {
+			report.add(name, addr, in[:replaceLen], PreflightPass, "relocating %d bytes", replaceLen)
+		}
+	}
+
+	if allocStart > allocLimit {
+		report.add("Patch space", allocStart, nil, PreflightFail, "user code overlaps the I2C transfer buffer at %04x", allocLimit)
+	} else if allocEnd > allocLimit {
+		report.add("Patch space", allocStart, nil, PreflightFail, "needs %d bytes, only %d available", allocEnd-allocStart, allocLimit-allocStart)
+	} else {
+		report.add("Patch space", allocStart, nil, PreflightPass, "%d bytes up to %04x", allocEnd-allocStart, allocEnd)
+	}
+
+	/* ROM helpers called by the HAL */
+	code := h.patchROMCode(callAddrs)
+	scl, sda := 0, 0
+
+	for _, m := range h.patchProfileGet().helpers() {
+		if code == nil {
+			report.add(m.name, m.addr, nil, PreflightSkipped, "CODE not readable, give a ROM dump")
+			continue
+		}
+
+		f, err := romFuncRead(code, m.addr)
+		if errors.Is(err, errROMFuncOutside) {
+			report.add(m.name, m.addr, nil, PreflightFail, "outside of the ROM dump")
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var start []byte
+		for _, insn := range f.insns {
+			if len(start) >= 4 {
+				break
+			}
+			start = append(start, insn...)
+		}
+
+		if m.addr == h.patchProfileGet().i2cStart {
+			scl, sda, _ = f.i2cPins()
+		}
+
+		if !f.ended {
+			report.add(m.name, m.addr, start, PreflightFail, "not a function, no RET found")
+		} else if m.check == nil {
+			report.add(m.name, m.addr, start, PreflightPass, "%d instructions", len(f.insns))
+		} else if problem := m.check(f, scl, sda); problem != "" {
+			report.add(m.name, m.addr, start, PreflightFail, "%s", problem)
+		} else if m.addr == h.patchProfileGet().i2cStart {
+			report.add(m.name, m.addr, start, PreflightPass, "SCL %02X.%d, SDA %02X.%d", scl&0xf8, scl&7, sda&0xf8, sda&7)
+		} else {
+			report.add(m.name, m.addr, start, PreflightPass, "matches signature")
+		}
+	}
+
+	return report, nil
+}
+
+/* patchROMCode returns the CODE region from PatchROMImage, or through the MOVC blob of the
+ * running patch at callAddrs. It returns nil if CODE can't be read. */
+func (h *HAL) patchROMCode(callAddrs []int) MemoryRegion {
+	if h.config.PatchROMImage != nil {
+		return regionWrapBuffer(MemoryRegionCODE, h.config.PatchROMImage)
+	} else if callAddrs != nil {
+		return regionWrapCompleteIO(halPatchCodeMemoryRegion{hal: h, movcAddr: callAddrs[2]})
+	}
+	return nil
+}
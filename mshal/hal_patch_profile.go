@@ -0,0 +1,132 @@
+package mshal
+
+import "fmt"
+
+/* Addresses of ROM functions used by the patch. These are fixed per chip as they live in mask ROM. */
+type patchProfile struct {
+	i2cStart int
+	i2cStop  int
+	i2cWrite int
+	i2cRead  int /* MS2106: function entry, others: jump target of the i2cRead blob */
+
+	i2cReadAckBit int  /* Bit that selects ACK/NACK for i2cRead, 0 if it is taken from R7 */
+	i2cWriteAckR7 bool /* i2cWrite returns the ACK in R7 instead of C */
+
+	tvdRead  int
+	tvdWrite int
+
+	eepromLoad int
+	usbIRQ     int
+}
+
+var patchProfile2106 = patchProfile{
+	i2cStart: 0x3639,
+	i2cStop:  0x3730,
+	i2cWrite: 0x2126,
+	i2cRead:  0x26cb,
+
+	i2cWriteAckR7: true,
+
+	tvdRead:    0x3a33,
+	tvdWrite:   0x3a17,
+	eepromLoad: 0x1282,
+}
+
+var patchProfile2107 = patchProfile{
+	i2cStart: 0x68bd,
+	i2cStop:  0x6b5b,
+	i2cWrite: 0x5323,
+	i2cRead:  0x5934,
+
+	i2cReadAckBit: 0x1d,
+
+	eepromLoad: 0x6656,
+	usbIRQ:     0x54ae,
+}
+
+var patchProfile2109 = patchProfile{
+	i2cStart: 0x6a8c,
+	i2cStop:  0x6aba,
+	i2cWrite: 0x4648,
+	i2cRead:  0x4cf3,
+
+	i2cReadAckBit: 0x08,
+
+	eepromLoad: 0x5f19,
+}
+
+func (h *HAL) patchProfileGet() *patchProfile {
+	if h.deviceType == 2106 {
+		return &patchProfile2106
+	} else if h.deviceType == 2107 {
+		return &patchProfile2107
+	} else if h.deviceType == 2109 {
+		return &patchProfile2109
+	}
+
+	return nil
+}
+
+/* Signature of a ROM helper, it returns what is wrong with the code or an empty string. The
+ * I2C pins are taken from the I2C start function, which is checked first. */
+type patchProfileCheck func(f *romFunc, scl int, sda int) string
+
+type patchProfileHelper struct {
+	name  string
+	addr  int
+	check patchProfileCheck
+}
+
+func (p *patchProfile) helpers() []patchProfileHelper {
+	list := []patchProfileHelper{
+		{"I2C start", p.i2cStart, checkI2CStart},
+		{"I2C stop", p.i2cStop, checkI2CStop},
+		{"I2C write", p.i2cWrite, p.checkI2CWrite},
+		{"I2C read", p.i2cRead, p.checkI2CRead},
+		{"EEPROM load", p.eepromLoad, nil},
+	}
+
+	if p.tvdRead != 0 {
+		list = append(list, patchProfileHelper{"TVD read", p.tvdRead, nil})
+		list = append(list, patchProfileHelper{"TVD write", p.tvdWrite, nil})
+	}
+	if p.usbIRQ != 0 {
+		list = append(list, patchProfileHelper{"USB IRQ", p.usbIRQ, nil})
+	}
+
+	return list
+}
+
+func checkI2CStart(f *romFunc, scl int, sda int) string {
+	if _, _, ok := f.i2cPins(); !ok {
+		return "does not pull SDA and then SCL low"
+	}
+	return ""
+}
+
+func checkI2CStop(f *romFunc, scl int, sda int) string {
+	if !f.usesBit(scl, i8051SETBBit, i8051MOVBitC) || !f.usesBit(sda, i8051SETBBit, i8051MOVBitC) {
+		return "does not release SCL and SDA"
+	}
+	return ""
+}
+
+func (p *patchProfile) checkI2CWrite(f *romFunc, scl int, sda int) string {
+	if !f.usesBit(sda, i8051MOVBitC, i8051CLRBit, i8051SETBBit) {
+		return "does not drive SDA"
+	} else if !f.usesBit(sda, i8051MOVCBit, i8051JB, i8051JNB, i8051JBC) {
+		return "does not sample the ACK on SDA"
+	} else if p.i2cWriteAckR7 && !f.hasOpcode(0x7f, 0xaf, 0xff) {
+		return "does not return the ACK in R7"
+	}
+	return ""
+}
+
+func (p *patchProfile) checkI2CRead(f *romFunc, scl int, sda int) string {
+	if !f.usesBit(sda, i8051MOVCBit, i8051JB, i8051JNB, i8051JBC) {
+		return "does not sample SDA"
+	} else if p.i2cReadAckBit != 0 && !f.usesBit(p.i2cReadAckBit, i8051JBC, i8051JB, i8051JNB, i8051MOVCBit, 0x72, 0x82, 0xa0, 0xb0) {
+		return fmt.Sprintf("does not use the ACK bit %02X.%d", p.i2cReadAckBit&0xf8, p.i2cReadAckBit&7)
+	}
+	return ""
+}
@@ -0,0 +1,144 @@
+package mshal
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/* 8051 instruction lengths, indexed by opcode */
+const i8051InsnLens = "" +
+	"1231121111111111" + "3231121111111111" + "3211221111111111" + "3211221111111111" +
+	"2223221111111111" + "2223221111111111" + "2223221111111111" + "2221232222222222" +
+	"2221132222222222" + "3221221111111111" + "2221112222222222" + "2221333333333333" +
+	"2221121111111111" + "2221131122222222" + "1211121111111111" + "1211121111111111"
+
+/* Opcodes that take a bit address as first operand */
+const (
+	i8051JBC     = 0x10
+	i8051JB      = 0x20
+	i8051JNB     = 0x30
+	i8051MOVBitC = 0x92
+	i8051MOVCBit = 0xa2
+	i8051CLRBit  = 0xc2
+	i8051SETBBit = 0xd2
+)
+
+/* Maximum number of instructions read from a ROM function, including the functions it calls */
+const romFuncMaxInsns = 256
+
+var errROMFuncOutside = errors.New("function runs outside of the ROM dump")
+
+/* romFunc holds the instructions of a ROM function in the order they are laid out. Unconditional
+ * jumps are followed, conditional ones fall through, and called functions are included once. */
+type romFunc struct {
+	insns [][]byte
+	ended bool /* A RET, RETI or indirect jump was reached */
+}
+
+func romFuncRead(code MemoryRegion, addr int) (*romFunc, error) {
+	f := &romFunc{}
+	return f, f.read(code, addr, 1)
+}
+
+func (f *romFunc) read(code MemoryRegion, addr int, depth int) error {
+	for len(f.insns) < romFuncMaxInsns {
+		insn := make([]byte, 3)
+		if n, err := code.Access(false, addr, insn[:1]); err != nil {
+			return err
+		} else if n < 1 {
+			return errROMFuncOutside
+		}
+
+		/* 0xA5 is not an instruction, this is not code */
+		if insn[0] == 0xa5 {
+			return nil
+		}
+
+		l := int(i8051InsnLens[insn[0]] - '0')
+		if l > 1 {
+			if n, err := code.Access(false, addr+1, insn[1:l]); err != nil {
+				return err
+			} else if n < l-1 {
+				return errROMFuncOutside
+			}
+		}
+		insn = insn[:l]
+		f.insns = append(f.insns, insn)
+
+		/* RET, RETI, JMP @A+DPTR */
+		if insn[0] == 0x22 || insn[0] == 0x32 || insn[0] == 0x73 {
+			if depth == 1 {
+				f.ended = true
+			}
+			return nil
+		}
+
+		next := addr + l
+		if insn[0] == 0x02 {
+			next = int(binary.BigEndian.Uint16(insn[1:]))
+		} else if insn[0] == 0x80 {
+			next += int(int8(insn[1]))
+		} else if insn[0]&0x1f == 0x01 {
+			next = next&0xf800 | int(insn[0]>>5)<<8 | int(insn[1])
+		} else if depth > 0 && (insn[0] == 0x12 || insn[0]&0x1f == 0x11) {
+			called := int(binary.BigEndian.Uint16(insn[1:]))
+			if insn[0] != 0x12 {
+				called = next&0xf800 | int(insn[0]>>5)<<8 | int(insn[1])
+			}
+			if err := f.read(code, called, depth-1); err != nil {
+				return err
+			}
+		}
+		addr = next
+	}
+
+	return nil
+}
+
+/* bits returns the bit operands of the instructions with one of the given opcodes, in order */
+func (f *romFunc) bits(ops ...byte) []int {
+	var result []int
+	for _, m := range f.insns {
+		for _, op := range ops {
+			if m[0] == op {
+				result = append(result, int(m[1]))
+			}
+		}
+	}
+	return result
+}
+
+func (f *romFunc) usesBit(bit int, ops ...byte) bool {
+	for _, m := range f.bits(ops...) {
+		if m == bit {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *romFunc) hasOpcode(ops ...byte) bool {
+	for _, m := range f.insns {
+		for _, op := range ops {
+			if m[0] == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* i2cPins returns the SCL and SDA bits from the ROM I2C start function. A start condition pulls
+ * SDA low while SCL is high and then pulls SCL low, so these are the first and last bit cleared. */
+func (f *romFunc) i2cPins() (int, int, bool) {
+	cleared := f.bits(i8051CLRBit)
+	if len(cleared) < 2 {
+		return 0, 0, false
+	}
+
+	scl, sda := cleared[len(cleared)-1], cleared[0]
+	if scl == sda || scl < 0x80 || sda < 0x80 {
+		return 0, 0, false
+	}
+	return scl, sda, true
+}
@@ -0,0 +1,133 @@
+package mshal
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"errors"
+)
+
+//go:embed asm/spi.bin
+var codeSPI []byte
+
+/* Offsets of the addresses in spi.bin that point into the blob itself */
+var codeSPIRelocs = []int{64, 88, 91, 94, 97, 100, 103, 108, 111, 114, 117, 120, 123, 139}
+
+/* spi.bin reads the pin masks and the delay in front of the data */
+const spiParamsLen = 6
+
+/* The code around the delay takes about 10 loop iterations per half clock period */
+const spiOverhead = 10
+
+func relocateSPI(result []byte, addr int) (int, []byte) {
+	for _, m := range codeSPIRelocs {
+		if result[m-1] != 0x12 {
+			panic("Offset is not LCALL")
+		}
+
+		target := binary.BigEndian.Uint16(result[m:])
+		binary.BigEndian.PutUint16(result[m:], target+uint16(addr))
+	}
+
+	return addr, result
+}
+
+/* SPIPins selects the P2 pins (0-7) used for SPI */
+type SPIPins struct {
+	SCK  int
+	MOSI int
+	MISO int
+	CS   int
+}
+
+func (h *HAL) spiPins() (SPIPins, error) {
+	pins := SPIPins{SCK: 0, MOSI: 1, MISO: 2, CS: 3}
+	if h.config.SPIPins != nil {
+		pins = *h.config.SPIPins
+	}
+
+	var used byte
+	for _, m := range []int{pins.SCK, pins.MOSI, pins.MISO, pins.CS} {
+		if m < 0 || m > 7 || used&(1<<m) > 0 {
+			return pins, errors.New("SPI pins must be different GPIOs between 0 and 7")
+		}
+		used |= 1 << m
+	}
+
+	return pins, nil
+}
+
+/* SPITransfer selects the device, clocks out tx followed by rxLen 0xff bytes and returns all
+ * len(tx)+rxLen bytes that were received. Bit 0 of mode is CPHA, bit 1 is CPOL. */
+func (h *HAL) SPITransfer(mode int, tx []byte, rxLen int) ([]byte, error) {
+	if !h.patchInstalled {
+		return nil, ErrorMissingFunction
+	}
+
+	if mode < 0 || mode > 3 {
+		return nil, errors.New("SPI mode must be between 0 and 3")
+	}
+	if rxLen < 0 {
+		return nil, errors.New("SPI read length can't be negative")
+	}
+
+	pins, err := h.spiPins()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, len(tx)+rxLen)
+	copy(data, tx)
+	for i := len(tx); i < len(data); i++ {
+		data[i] = 0xff
+	}
+
+	/* The loops count down from these values, like in UARTTransmit */
+	delay := uint16(0)
+	if h.config.SPISpeed > 0 {
+		delay, _ = bitBangDelay(h.config.SPISpeed, spiOverhead)
+	}
+	params := []byte{1 << pins.SCK, 1 << pins.MOSI, 1 << pins.MISO, 1 << pins.CS, byte(delay) + 1, byte(delay>>8) + 1}
+
+	/* Transfers that don't fit in the buffer are split, CS stays asserted in between */
+	ram, bufAddr := h.patchI2CTransferBuffer()
+	chunk := i2cTransferBatchMax - spiParamsLen
+
+	for offset := 0; offset == 0 || offset < len(data); offset += chunk {
+		end := offset + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+
+		flags := byte(mode)
+		if offset == 0 {
+			flags |= 4
+		}
+		if end == len(data) {
+			flags |= 8
+		}
+
+		/* Only the parameters have to be written when reading */
+		wrBuf := params
+		if offset < len(tx) {
+			wrBuf = append(params, data[offset:end]...)
+		} else {
+			flags |= 0x10
+		}
+
+		if _, err := ram.Access(true, bufAddr, wrBuf); err != nil {
+			return nil, err
+		}
+		if _, err := h.PatchExecFunc(true, h.patchCallAddrs[6], PatchExecFuncRequest{
+			DPTR: uint16(bufAddr),
+			R6:   byte(end - offset),
+			R7_A: flags,
+		}); err != nil {
+			return nil, err
+		}
+		if err := h.patchReadBuffer(bufAddr+spiParamsLen, data[offset:end]); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
@@ -21,7 +21,7 @@ func (h halPatchTVDMemoryRegion) read(addr int, buf []byte) (int, error) {
 		R7_A: uint8(addr),
 	}
 
-	resp, err := h.hal.PatchExecFunc(false, 0x3a33, req)
+	resp, err := h.hal.PatchExecFunc(false, h.hal.patchProfileGet().tvdRead, req)
 	if err != nil {
 		return 0, err
 	}
@@ -36,7 +36,7 @@ func (h halPatchTVDMemoryRegion) write(addr int, buf []byte) (int, error) {
 		R7_A: uint8(addr),
 	}
 
-	_, err := h.hal.PatchExecFunc(false, 0x3a17, req)
+	_, err := h.hal.PatchExecFunc(false, h.hal.patchProfileGet().tvdWrite, req)
 	if err != nil {
 		return 0, err
 	}
@@ -50,12 +50,17 @@ func (h *HAL) memoryRegionB9(base int, len int) MemoryRegion {
 }
 
 func (h *HAL) memoryRegionEEPROM() MemoryRegion {
+	return h.memoryRegionEEPROMSized(h.eepromSize)
+}
+
+/* memoryRegionEEPROMSized reads the EEPROM through the ROM before its size is known */
+func (h *HAL) memoryRegionEEPROMSized(size int) MemoryRegion {
 	read, write := romCommandMakeReadWrite(0xe5, true)
 	if h.deviceType != 2106 {
 		read.maxPayload = 5
 		read.cbApplyParam = romEepromV2HandleTwoByteAddress
 	}
-	region := h.romMemoryRegionMake(MemoryRegionEEPROM, 0, h.eepromSize, 1, &read, &write)
+	region := h.romMemoryRegionMake(MemoryRegionEEPROM, 0, size, 1, &read, &write)
 
 	/* The EEPROM takes time to write, so try to read again.
 	   MS2109 has internal delay (quite long) */
@@ -208,7 +208,7 @@ func (h *HAL) romMemoryRegionMake(name MemoryRegionNameType, baseAddr int, lengt
 }
 
 func romEepromV2HandleTwoByteAddress(h *HAL, out []byte) error {
-	if h.eepromSize > 2048 {
+	if h.eepromAddrBytes() == 2 {
 		out[8] = 1
 	}
 	return nil
@@ -218,7 +218,7 @@ func romEepromVerify(region MemoryRegion) cbPostExchangeType {
 	return func(h *HAL, addr int, buf []byte) error {
 		if buf[0] == 0 {
 			/* The chip returns 0 if there is no I2C response, so we just have to wait */
-			time.Sleep(15 * time.Millisecond)
+			time.Sleep(h.eepromWriteTimeout())
 			return nil
 		}
 
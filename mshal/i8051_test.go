@@ -0,0 +1,250 @@
+package mshal
+
+import "fmt"
+
+/* i8051 runs patch blobs for the fake devices. It knows the instructions the I2C transfer blob and
+ * its stubs use, calls into the ROM are handed to rom, which has to do what the function does. */
+type i8051 struct {
+	a, b byte
+	c    bool
+	dptr uint16
+	sp   byte
+	iram [256]byte /* R0-R7 are in bank 0 */
+
+	xdata *[0x10000]byte
+	rom   func(cpu *i8051, addr int) error
+}
+
+const i8051Return = 0xffff
+
+func (cpu *i8051) r(n byte) *byte {
+	return &cpu.iram[n&7]
+}
+
+func (cpu *i8051) direct(addr byte) *byte {
+	switch addr {
+	case 0xe0:
+		return &cpu.a
+	case 0xf0:
+		return &cpu.b
+	}
+	if addr >= 0x80 {
+		return nil
+	}
+	return &cpu.iram[addr]
+}
+
+func (cpu *i8051) readDirect(addr byte) (byte, error) {
+	switch addr {
+	case 0x82:
+		return byte(cpu.dptr), nil
+	case 0x83:
+		return byte(cpu.dptr >> 8), nil
+	}
+	if p := cpu.direct(addr); p != nil {
+		return *p, nil
+	}
+	return 0, fmt.Errorf("SFR %02x not emulated", addr)
+}
+
+func (cpu *i8051) writeDirect(addr byte, value byte) error {
+	switch addr {
+	case 0x82:
+		cpu.dptr = cpu.dptr&0xff00 | uint16(value)
+		return nil
+	case 0x83:
+		cpu.dptr = cpu.dptr&0xff | uint16(value)<<8
+		return nil
+	}
+	if p := cpu.direct(addr); p != nil {
+		*p = value
+		return nil
+	}
+	return fmt.Errorf("SFR %02x not emulated", addr)
+}
+
+func (cpu *i8051) push(value byte) {
+	cpu.sp++
+	cpu.iram[cpu.sp] = value
+}
+
+func (cpu *i8051) pop() byte {
+	value := cpu.iram[cpu.sp]
+	cpu.sp--
+	return value
+}
+
+func (cpu *i8051) ret() int {
+	hi := cpu.pop()
+	return int(hi)<<8 | int(cpu.pop())
+}
+
+/* setBit supports the bit addressable IRAM, which the ROM functions use for flags */
+func (cpu *i8051) setBit(bit byte, value bool) error {
+	if bit >= 0x80 {
+		return fmt.Errorf("bit %02x not emulated", bit)
+	}
+	mask := byte(1) << (bit & 7)
+	cpu.iram[0x20+bit>>3] &^= mask
+	if value {
+		cpu.iram[0x20+bit>>3] |= mask
+	}
+	return nil
+}
+
+func (cpu *i8051) bit(bit byte) bool {
+	return cpu.iram[0x20+bit>>3]&(1<<(bit&7)) != 0
+}
+
+func (cpu *i8051) subb(value byte) {
+	borrow := 0
+	if cpu.c {
+		borrow = 1
+	}
+	cpu.c = int(cpu.a) < int(value)+borrow
+	cpu.a -= value + byte(borrow)
+}
+
+/* call runs the function at pc until it returns */
+func (cpu *i8051) call(pc int) error {
+	cpu.sp = 0x2f
+	cpu.push(i8051Return & 0xff)
+	cpu.push(i8051Return >> 8)
+
+	for steps := 0; pc != i8051Return; steps++ {
+		if steps > 100000 {
+			return fmt.Errorf("no return from %04x", pc)
+		}
+
+		if pc < 0xc000 {
+			if err := cpu.rom(cpu, pc); err != nil {
+				return err
+			}
+			pc = cpu.ret()
+			continue
+		}
+
+		m := cpu.xdata[pc:]
+		op := m[0]
+		next := pc + int(i8051InsnLens[op]-'0')
+		rel := func(offset int) int {
+			return next + int(int8(m[offset]))
+		}
+
+		switch {
+		case op == 0x02:
+			next = int(m[1])<<8 | int(m[2])
+		case op == 0x12:
+			cpu.push(byte(next))
+			cpu.push(byte(next >> 8))
+			next = int(m[1])<<8 | int(m[2])
+		case op == 0x22:
+			next = cpu.ret()
+		case op == 0x80:
+			next = rel(1)
+		case op == 0x60 && cpu.a == 0, op == 0x70 && cpu.a != 0, op == 0x50 && !cpu.c, op == 0x40 && cpu.c:
+			next = rel(1)
+		case op == 0x60, op == 0x70, op == 0x50, op == 0x40:
+		case op == 0x73:
+			next = int(cpu.dptr) + int(cpu.a)
+		case op == 0x30 || op == 0x20:
+			value, err := cpu.readDirect(m[1] &^ 7)
+			if err != nil {
+				return err
+			}
+			if (value&(1<<(m[1]&7)) != 0) == (op == 0x20) {
+				next = rel(2)
+			}
+		case op >= 0xe8 && op <= 0xef:
+			cpu.a = *cpu.r(op)
+		case op >= 0xf8:
+			*cpu.r(op) = cpu.a
+		case op >= 0x78 && op <= 0x7f:
+			*cpu.r(op) = m[1]
+		case op == 0x74:
+			cpu.a = m[1]
+		case op == 0xe5:
+			value, err := cpu.readDirect(m[1])
+			if err != nil {
+				return err
+			}
+			cpu.a = value
+		case op == 0xf5:
+			if err := cpu.writeDirect(m[1], cpu.a); err != nil {
+				return err
+			}
+		case op == 0x75:
+			if err := cpu.writeDirect(m[1], m[2]); err != nil {
+				return err
+			}
+		case op == 0x90:
+			cpu.dptr = uint16(m[1])<<8 | uint16(m[2])
+		case op == 0xa3:
+			cpu.dptr++
+		case op == 0xe0:
+			cpu.a = cpu.xdata[cpu.dptr]
+		case op == 0xf0:
+			cpu.xdata[cpu.dptr] = cpu.a
+		case op >= 0x08 && op <= 0x0f:
+			*cpu.r(op)++
+		case op == 0x04:
+			cpu.a++
+		case op == 0xe4:
+			cpu.a = 0
+		case op == 0xc3:
+			cpu.c = false
+		case op == 0xd3:
+			cpu.c = true
+		case op == 0x13:
+			c := cpu.a&1 != 0
+			cpu.a >>= 1
+			if cpu.c {
+				cpu.a |= 0x80
+			}
+			cpu.c = c
+		case op >= 0x48 && op <= 0x4f:
+			cpu.a |= *cpu.r(op)
+		case op == 0x44:
+			cpu.a |= m[1]
+		case op == 0x54:
+			cpu.a &= m[1]
+		case op == 0x24:
+			cpu.c = int(cpu.a)+int(m[1]) > 0xff
+			cpu.a += m[1]
+		case op >= 0x98 && op <= 0x9f:
+			cpu.subb(*cpu.r(op))
+		case op == 0x94:
+			cpu.subb(m[1])
+		case op >= 0xd8 && op <= 0xdf:
+			*cpu.r(op)--
+			if *cpu.r(op) != 0 {
+				next = rel(1)
+			}
+		case op >= 0xb8 && op <= 0xbf:
+			cpu.c = *cpu.r(op) < m[1]
+			if *cpu.r(op) != m[1] {
+				next = rel(2)
+			}
+		case op == 0xc0:
+			value, err := cpu.readDirect(m[1])
+			if err != nil {
+				return err
+			}
+			cpu.push(value)
+		case op == 0xd0:
+			if err := cpu.writeDirect(m[1], cpu.pop()); err != nil {
+				return err
+			}
+		case op == 0x92:
+			if err := cpu.setBit(m[1], cpu.c); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("opcode %02x at %04x not emulated", op, pc)
+		}
+
+		pc = next
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package ms213x
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+/* Builds identified by the SHA-256 of their code */
+var knownBuilds = map[string]string{
+	"cc67f79a043da85dc8e6688a22111ade626e519e1ab549f110b3a06308190047": "MS2130 firmware supported by ms213x_patch",
+	"2c3c28881afe15dbce9b73d1cefd226496f3d5d5fc51e3f302264ea21c858253": "MS2130 firmware from backup.bin",
+	"1f56ab38b8f4a990dda441da06f895839bf61976e578d008e26c71c61f4ccb70": "ROM dump firmware",
+}
+
+/* Code added by ms213x_patch to write "BVDB" to XDATA 0x7b00 */
+var patchMarkerCode = []byte{
+	0x90, 0x7b, 0x00,
+	0x74, 'B', 0xf0, 0xa3,
+	0x74, 'V', 0xf0, 0xa3,
+	0x74, 'D', 0xf0, 0xa3,
+	0x74, 'B', 0xf0,
+}
+
+type Build struct {
+	Hash string
+	Name string /* Empty if the build is unknown */
+
+	/* The code announces itself at XDATA 0x7b00, so the host can call functions */
+	Patched bool
+}
+
+func (b Build) String() string {
+	name := b.Name
+	if name == "" {
+		name = "unknown build"
+	}
+	if b.Patched {
+		name += ", patched"
+	}
+	return name + " (sha256 " + b.Hash + ")"
+}
+
+/* Identify looks up the code in the list of known builds */
+func (img *Image) Identify() Build {
+	hash := sha256.Sum256(img.Code)
+
+	b := Build{
+		Hash:    hex.EncodeToString(hash[:]),
+		Patched: bytes.Contains(img.Code, patchMarkerCode),
+	}
+	b.Name = knownBuilds[b.Hash]
+	return b
+}
@@ -0,0 +1,94 @@
+package ms213x
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+/* backup.bin in the repository root is a complete MS2130 flash image */
+func loadBackup(t *testing.T) []byte {
+	f, err := os.ReadFile("../../backup.bin")
+	if err != nil {
+		t.Skip(err)
+	}
+	return f
+}
+
+func TestChecksumsBackup(t *testing.T) {
+	f := loadBackup(t)
+
+	img, err := Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Code) != 51625 || len(img.Trailer) != 0 {
+		t.Errorf("code %d bytes, trailer %d bytes, expected 51625 and 0", len(img.Code), len(img.Trailer))
+	}
+
+	hdrSum, codeSum := img.Checksums()
+	if hdrSum != 0x25ce || codeSum != 0xc059 {
+		t.Errorf("checksums %04x %04x, expected 25ce c059", hdrSum, codeSum)
+	}
+	if img.HeaderSum != hdrSum || img.CodeSum != codeSum {
+		t.Errorf("stored checksums %04x %04x differ", img.HeaderSum, img.CodeSum)
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	orig := loadBackup(t)
+	end := HeaderLen + 51625
+
+	tests := []struct {
+		name   string
+		offset int
+		err    string
+	}{
+		{"unchanged", -1, ""},
+		{"byte not covered by the header checksum", offsetUnsummed, ""},
+		{"option byte", offsetOptions, "header checksum mismatch"},
+		{"name area", offsetName, "header checksum mismatch"},
+		{"code byte", HeaderLen + 0x100, "code checksum mismatch"},
+		{"stored code checksum", end + 3, "code checksum mismatch"},
+		{"magic", 0, "unknown magic"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := append([]byte{}, orig...)
+			if tc.offset >= 0 {
+				f[tc.offset] ^= 0x01
+			}
+
+			err := CheckImage(f)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+
+			/* FixImage makes it valid again, unless it is not an image at all */
+			if tc.offset == 0 {
+				return
+			}
+			FixImage(f)
+			if err := CheckImage(f); err != nil {
+				t.Errorf("after FixImage: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	f := loadBackup(t)
+
+	for _, n := range []int{0, HeaderLen - 1, HeaderLen + 100, len(f) - 1} {
+		if _, err := Parse(f[:n]); err == nil {
+			t.Errorf("%d bytes: expected an error", n)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package ms213x
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/* Image layout, all values are big endian:
+ *   0x00-0x01  magic
+ *   0x02-0x03  code length
+ *   0x04-0x0b  options, covered by the header checksum
+ *   0x0c-0x0f  not covered by the header checksum
+ *   0x10-0x2f  free area, the ROM dump firmware stores a length-prefixed name here
+ *   0x30-...   code, followed by the header and code checksums
+ * Anything behind the checksums is data the firmware reads from the flash at runtime. */
+const (
+	HeaderLen   = 0x30
+	ChecksumLen = 4
+
+	offsetLength   = 0x02
+	offsetOptions  = 0x04
+	offsetUnsummed = 0x0c
+	offsetName     = 0x10
+)
+
+type Magic uint16
+
+const (
+	Magic5AA5 Magic = 0x5aa5
+	Magic6996 Magic = 0x6996
+	Magic3CC3 Magic = 0x3cc3
+)
+
+/* The loader accepts three magics with the same layout. 0x3cc3 is used by the MS2130 modules
+ * and the ROM dump firmware, the others have not been seen in flash dumps. */
+func (m Magic) String() string {
+	switch m {
+	case Magic5AA5, Magic6996:
+		return fmt.Sprintf("%04x (accepted by loader, not seen on MS2130 modules)", uint16(m))
+	case Magic3CC3:
+		return fmt.Sprintf("%04x (MS2130 firmware)", uint16(m))
+	}
+	return fmt.Sprintf("%04x (unknown)", uint16(m))
+}
+
+func (m Magic) Valid() bool {
+	return m == Magic5AA5 || m == Magic6996 || m == Magic3CC3
+}
+
+type Image struct {
+	Header []byte
+	Code   []byte
+
+	/* Checksums as stored in the image, see Checksums for the correct values */
+	HeaderSum uint16
+	CodeSum   uint16
+
+	/* Everything stored behind the firmware */
+	Trailer []byte
+}
+
+/* ParseError tells which part of the image is invalid */
+type ParseError struct {
+	Offset int
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("offset 0x%04x: %s", e.Offset, e.Reason)
+}
+
+/* Parse splits a flash image into its parts. The checksums are not verified, use Check for that. */
+func Parse(f []byte) (*Image, error) {
+	if len(f) < HeaderLen {
+		return nil, &ParseError{len(f), fmt.Sprintf("file too short for header: need %d bytes, have %d", HeaderLen, len(f))}
+	}
+
+	if m := Magic(binary.BigEndian.Uint16(f)); !m.Valid() {
+		return nil, &ParseError{0, fmt.Sprintf("unknown magic %04x, expected %04x, %04x or %04x", uint16(m), uint16(Magic5AA5), uint16(Magic6996), uint16(Magic3CC3))}
+	}
+
+	codeLen := int(binary.BigEndian.Uint16(f[offsetLength:]))
+	end := HeaderLen + codeLen
+	if len(f) < end {
+		return nil, &ParseError{offsetLength, fmt.Sprintf("code length %d needs %d bytes, file has %d", codeLen, end, len(f))}
+	}
+	if len(f) < end+ChecksumLen {
+		return nil, &ParseError{end, fmt.Sprintf("file too short for checksums: need %d bytes, have %d", end+ChecksumLen, len(f))}
+	}
+
+	return &Image{
+		Header:    append([]byte{}, f[:HeaderLen]...),
+		Code:      append([]byte{}, f[HeaderLen:end]...),
+		HeaderSum: binary.BigEndian.Uint16(f[end:]),
+		CodeSum:   binary.BigEndian.Uint16(f[end+2:]),
+		Trailer:   append([]byte{}, f[end+ChecksumLen:]...),
+	}, nil
+}
+
+/* NewImage creates an image for code with the header used by the ROM dump firmware */
+func NewImage(code []byte) *Image {
+	img := &Image{
+		Header: make([]byte, HeaderLen),
+		Code:   append([]byte{}, code...),
+	}
+
+	for i := range img.Header {
+		img.Header[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(img.Header, uint16(Magic3CC3))
+	for i := offsetOptions + 4; i < offsetUnsummed; i++ {
+		img.Header[i] = 0
+	}
+
+	img.Fix()
+	return img
+}
+
+func (img *Image) Magic() Magic {
+	return Magic(binary.BigEndian.Uint16(img.Header))
+}
+
+/* Options returns the header bytes between the code length and the part without checksum */
+func (img *Image) Options() []byte {
+	return img.Header[offsetOptions:offsetUnsummed]
+}
+
+/* Name returns the length-prefixed string at 0x10, the length includes the length byte */
+func (img *Image) Name() string {
+	l := int(img.Header[offsetName])
+	if l < 2 || offsetName+l > HeaderLen {
+		return ""
+	}
+	return string(img.Header[offsetName+1 : offsetName+l])
+}
+
+/* Checksums calculates the header and code checksums */
+func (img *Image) Checksums() (uint16, uint16) {
+	header := append([]byte{}, img.Header...)
+	binary.BigEndian.PutUint16(header[offsetLength:], uint16(len(img.Code)))
+
+	hdrSum := calcSum(header[offsetLength:offsetUnsummed]) + calcSum(header[offsetName:])
+	return hdrSum, calcSum(img.Code)
+}
+
+/* Check verifies the code length and the checksums, reporting every problem found */
+func (img *Image) Check() error {
+	var errs []error
+
+	if !img.Magic().Valid() {
+		errs = append(errs, &ParseError{0, fmt.Sprintf("unknown magic %04x", uint16(img.Magic()))})
+	}
+
+	if len(img.Code) > 0xffff {
+		errs = append(errs, &ParseError{offsetLength, fmt.Sprintf("code is %d bytes, at most 65535 fit in the header", len(img.Code))})
+	} else if codeLen := int(binary.BigEndian.Uint16(img.Header[offsetLength:])); codeLen != len(img.Code) {
+		errs = append(errs, &ParseError{offsetLength, fmt.Sprintf("code length is %d, code is %d bytes", codeLen, len(img.Code))})
+	}
+
+	end := HeaderLen + len(img.Code)
+	hdrSum, codeSum := img.Checksums()
+	if hdrSum != img.HeaderSum {
+		errs = append(errs, &ParseError{end, fmt.Sprintf("header checksum mismatch: %04x != %04x", img.HeaderSum, hdrSum)})
+	}
+	if codeSum != img.CodeSum {
+		errs = append(errs, &ParseError{end + 2, fmt.Sprintf("code checksum mismatch: %04x != %04x", img.CodeSum, codeSum)})
+	}
+
+	return errors.Join(errs...)
+}
+
+/* Fix updates the code length and checksums after the header or code were changed */
+func (img *Image) Fix() {
+	binary.BigEndian.PutUint16(img.Header[offsetLength:], uint16(len(img.Code)))
+	img.HeaderSum, img.CodeSum = img.Checksums()
+}
+
+/* Len returns the number of bytes used by the firmware, excluding the trailer */
+func (img *Image) Len() int {
+	return HeaderLen + len(img.Code) + ChecksumLen
+}
+
+/* Bytes builds the image with the stored checksums, call Fix first to update them */
+func (img *Image) Bytes() []byte {
+	out := make([]byte, 0, img.Len()+len(img.Trailer))
+	out = append(out, img.Header...)
+	out = append(out, img.Code...)
+	out = binary.BigEndian.AppendUint16(out, img.HeaderSum)
+	out = binary.BigEndian.AppendUint16(out, img.CodeSum)
+	return append(out, img.Trailer...)
+}
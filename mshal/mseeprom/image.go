@@ -0,0 +1,313 @@
+package mseeprom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/johnneerdael/ms-tools/mshal/ms213x"
+)
+
+type Chip int
+
+const (
+	ChipUnknown Chip = 0
+	ChipMS2106  Chip = 2106
+	ChipMS2107  Chip = 2107
+	ChipMS2109  Chip = 2109
+)
+
+func (c Chip) String() string {
+	if c == ChipUnknown {
+		return "unknown"
+	}
+	return fmt.Sprintf("MS%d", int(c))
+}
+
+/* Header length is the size of the USERCONFIG region, code is loaded right behind it */
+func (c Chip) HeaderLen() int {
+	if c == ChipMS2106 {
+		return 0x10
+	}
+	return 0x30
+}
+
+/* XDATA address the code is loaded to, right behind USERCONFIG */
+func (c Chip) CodeAddr() int {
+	switch c {
+	case ChipMS2106:
+		return 0xc000 + 0x3f0 + c.HeaderLen()
+	case ChipMS2107:
+		return 0xc000 + 0x7d0 + c.HeaderLen()
+	}
+	return 0xc000 + 0xbd0 + c.HeaderLen()
+}
+
+/* Space between the end of USERCONFIG and the end of USERRAM */
+func (c Chip) MaxCodeLen() int {
+	switch c {
+	case ChipMS2106:
+		return 0x1000 - 0x400
+	case ChipMS2107:
+		return 0x1400 - 0x800
+	}
+	return 0x2000 - 0xc00
+}
+
+/* The mshal patch keeps its I2C transfer buffer in the last bytes of USERRAM */
+const TransferBufferLen = 64
+
+/* MaxPatchableCodeLen is the longest code that leaves the I2C transfer buffer of the patch free */
+func (c Chip) MaxPatchableCodeLen() int {
+	return c.MaxCodeLen() - TransferBufferLen
+}
+
+func ChipFromMagic(magic uint16) Chip {
+	switch magic {
+	case 0x5aa5:
+		return ChipMS2106
+	case 0x0816, 0x3264:
+		return ChipMS2107
+	case 0xa55a, 0x9669:
+		return ChipMS2109
+	}
+	return ChipUnknown
+}
+
+type Image struct {
+	Chip Chip
+
+	Header []byte
+	Code   []byte
+
+	/* Header and code checksums follow the code */
+	HasChecksum bool
+
+	/* Everything stored behind the firmware */
+	Trailer []byte
+}
+
+func (img *Image) Magic() uint16 {
+	return binary.BigEndian.Uint16(img.Header)
+}
+
+/* HookAddr returns the XDATA address the ROM calls when a hook is enabled */
+func (c Chip) HookAddr(inIRQ bool) int {
+	switch c {
+	case ChipMS2106:
+		if inIRQ {
+			return 0xc4a0
+		}
+		return 0xc420
+	case ChipMS2107:
+		if inIRQ {
+			return 0xc810
+		}
+		return 0xc800
+	case ChipMS2109:
+		if inIRQ {
+			return 0xcc20
+		}
+		return 0xcc00
+	}
+	return 0
+}
+
+/* hookFlag returns the header byte that enables a hook. The MS2106 uses a magic value per hook,
+ * the others a bit in a shared byte. */
+func (c Chip) hookFlag(inIRQ bool) (int, byte, bool) {
+	switch c {
+	case ChipMS2106:
+		if inIRQ {
+			return 9, 0x96, false
+		}
+		return 5, 0x5a, false
+	case ChipMS2107:
+		if inIRQ {
+			return 8, 2, true
+		}
+		return 8, 1, true
+	case ChipMS2109:
+		if inIRQ {
+			return 4, 4, true
+		}
+		return 4, 1, true
+	}
+	return -1, 0, false
+}
+
+/* HookFlagOffset returns the offset of the header byte that enables a hook */
+func (c Chip) HookFlagOffset(inIRQ bool) int {
+	index, _, _ := c.hookFlag(inIRQ)
+	return index
+}
+
+/* HookEnabled tells if the header enables a hook */
+func (c Chip) HookEnabled(hdr []byte, inIRQ bool) bool {
+	index, value, isMask := c.hookFlag(inIRQ)
+	if index < 0 || index >= len(hdr) {
+		return false
+	}
+	if isMask {
+		return hdr[index]&value > 0
+	}
+	return hdr[index] == value
+}
+
+/* SetHook enables or disables a hook in the header */
+func (c Chip) SetHook(hdr []byte, inIRQ bool, enable bool) {
+	index, value, isMask := c.hookFlag(inIRQ)
+	if index < 0 || index >= len(hdr) {
+		return
+	}
+
+	if !isMask {
+		if !enable {
+			value = 0
+		}
+		hdr[index] = value
+		return
+	}
+
+	hdr[index] &= ^value
+	if enable {
+		hdr[index] |= value
+	}
+}
+
+func (img *Image) HookEnabled(inIRQ bool) bool {
+	return img.Chip.HookEnabled(img.Header, inIRQ)
+}
+
+func (img *Image) SetHook(inIRQ bool, enable bool) {
+	img.Chip.SetHook(img.Header, inIRQ, enable)
+}
+
+/* Config holds the header fields behind magic and code length. Headers of 0x30 bytes have the
+ * layout of an ms213x flash image. */
+type Config struct {
+	HookMain bool
+	HookIRQ  bool
+
+	Options  []byte /* Covered by the header checksum, includes the hook flags */
+	Reserved []byte /* Not covered by the header checksum, 0x30 byte headers only */
+	Name     string /* Length-prefixed name, 0x30 byte headers only */
+}
+
+func (img *Image) Config() Config {
+	cfg := Config{
+		HookMain: img.HookEnabled(false),
+		HookIRQ:  img.HookEnabled(true),
+	}
+
+	if len(img.Header) != ms213x.HeaderLen {
+		cfg.Options = img.Header[4:]
+		return cfg
+	}
+
+	fw := ms213x.Image{Header: img.Header}
+	cfg.Options = fw.Options()
+	cfg.Reserved = img.Header[len(cfg.Options)+4 : 0x10]
+	cfg.Name = fw.Name()
+	return cfg
+}
+
+/* Checksums used by images with a 0x30 byte header, calculated like ms213x */
+func Checksums(f []byte, codeLen int) (uint16, uint16) {
+	fw := ms213x.Image{
+		Header: f[:ms213x.HeaderLen],
+		Code:   f[ms213x.HeaderLen : ms213x.HeaderLen+codeLen],
+	}
+	return fw.Checksums()
+}
+
+func HasChecksum(f []byte, hdrLen int, codeLen int) bool {
+	end := hdrLen + codeLen
+	if hdrLen != ms213x.HeaderLen || len(f) < end+4 {
+		return false
+	}
+
+	hdrSum, codeSum := Checksums(f, codeLen)
+	return binary.BigEndian.Uint16(f[end:]) == hdrSum && binary.BigEndian.Uint16(f[end+2:]) == codeSum
+}
+
+/* Parse decodes an EEPROM image. If eepromSize is not zero the image is checked against it. */
+func Parse(f []byte, eepromSize int) (*Image, error) {
+	if len(f) < 4 {
+		return nil, errors.New("file too short (magic)")
+	}
+
+	if eepromSize > 0 && len(f) > eepromSize {
+		return nil, fmt.Errorf("image is %d bytes, larger than EEPROM (%d bytes)", len(f), eepromSize)
+	}
+
+	img := &Image{
+		Chip: ChipFromMagic(binary.BigEndian.Uint16(f)),
+	}
+	if img.Chip == ChipUnknown {
+		return nil, fmt.Errorf("unknown EEPROM magic: %04x", binary.BigEndian.Uint16(f))
+	}
+
+	hdrLen := img.Chip.HeaderLen()
+	if len(f) < hdrLen {
+		return nil, errors.New("file too short (hdr)")
+	}
+
+	codeLen := int(binary.BigEndian.Uint16(f[2:]))
+	if codeLen > img.Chip.MaxCodeLen() {
+		return nil, fmt.Errorf("code length %d exceeds %s user RAM (%d bytes)", codeLen, img.Chip, img.Chip.MaxCodeLen())
+	}
+
+	end := hdrLen + codeLen
+	if len(f) < end {
+		return nil, fmt.Errorf("file too short (code): need %d bytes, have %d", end, len(f))
+	}
+
+	img.HasChecksum = HasChecksum(f, hdrLen, codeLen)
+	if img.HasChecksum {
+		end += 4
+	}
+
+	img.Header = append([]byte{}, f[:hdrLen]...)
+	img.Code = append([]byte{}, f[hdrLen:hdrLen+codeLen]...)
+	img.Trailer = append([]byte{}, f[end:]...)
+
+	return img, nil
+}
+
+/* Len returns the number of bytes used by the firmware, excluding the trailer */
+func (img *Image) Len() int {
+	l := len(img.Header) + len(img.Code)
+	if img.HasChecksum {
+		l += 4
+	}
+	return l
+}
+
+/* Bytes rebuilds the image, updating the code length and checksums */
+func (img *Image) Bytes() []byte {
+	out := make([]byte, 0, img.Len()+len(img.Trailer))
+	out = append(out, img.Header...)
+	binary.BigEndian.PutUint16(out[2:], uint16(len(img.Code)))
+	out = append(out, img.Code...)
+
+	if img.HasChecksum {
+		hdrSum, codeSum := Checksums(out, len(img.Code))
+		out = binary.BigEndian.AppendUint16(out, hdrSum)
+		out = binary.BigEndian.AppendUint16(out, codeSum)
+	}
+
+	return append(out, img.Trailer...)
+}
+
+/* FixChecksum updates the checksums in f after it was edited in place, img must be parsed from the original */
+func (img *Image) FixChecksum(f []byte) {
+	if !img.HasChecksum {
+		return
+	}
+
+	end := len(img.Header) + len(img.Code)
+	hdrSum, codeSum := Checksums(f, len(img.Code))
+	binary.BigEndian.PutUint16(f[end:], hdrSum)
+	binary.BigEndian.PutUint16(f[end+2:], codeSum)
+}
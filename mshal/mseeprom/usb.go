@@ -0,0 +1,417 @@
+package mseeprom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+/* The firmware stores its USB descriptors as plain tables, so they are located by their signature */
+
+type USBString struct {
+	Index  int
+	Offset int
+	Value  string
+}
+
+/* Length of the string in characters, strings can't grow as the table is walked by length */
+func (s USBString) MaxLen() int {
+	return len(utf16.Encode([]rune(s.Value)))
+}
+
+type USBFrame struct {
+	Offset int
+	Format string
+	Width  int
+	Height int
+}
+
+type USBInterface struct {
+	Offset    int
+	Number    int
+	Alternate int
+	Class     byte
+	SubClass  byte
+	IName     int
+}
+
+func (i USBInterface) ClassName() string {
+	switch i.Class {
+	case 0x01:
+		return "audio"
+	case 0x0e:
+		return "video"
+	case 0x03:
+		return "HID"
+	}
+	return fmt.Sprintf("class %02x", i.Class)
+}
+
+/* USBDevice is a further device descriptor, some firmware has one for a second VID */
+type USBDevice struct {
+	Offset    int
+	VID       uint16
+	PID       uint16
+	BCDDevice uint16
+}
+
+type USBIdentity struct {
+	/* Offset of the device descriptor, -1 if not found */
+	DeviceOffset int
+	VID          uint16
+	PID          uint16
+	BCDDevice    uint16
+
+	Alternates []USBDevice
+
+	IManufacturer  int
+	IProduct       int
+	ISerial        int
+	IConfiguration int
+
+	Strings    []USBString
+	Interfaces []USBInterface
+	Frames     []USBFrame
+}
+
+func (id *USBIdentity) String(index int) *USBString {
+	if index == 0 {
+		return nil
+	}
+	for i := range id.Strings {
+		if id.Strings[i].Index == index {
+			return &id.Strings[i]
+		}
+	}
+	return nil
+}
+
+func isDeviceDescriptor(f []byte) bool {
+	if len(f) < 18 || f[0] != 0x12 || f[1] != 0x01 {
+		return false
+	}
+	/* bcdUSB 1.x, 2.x or 3.x */
+	if f[3] < 1 || f[3] > 3 {
+		return false
+	}
+	/* bMaxPacketSize0, 9 is 512 bytes for USB3 */
+	if f[7] != 8 && f[7] != 9 && f[7] != 16 && f[7] != 32 && f[7] != 64 {
+		return false
+	}
+	return f[17] >= 1 && f[17] <= 4
+}
+
+func parseStrings(f []byte) []USBString {
+	var result []USBString
+
+	start := strings.Index(string(f), "\x04\x03\x09\x04")
+	if start < 0 {
+		return nil
+	}
+
+	offset := start + 4
+	for index := 1; offset+2 <= len(f); index++ {
+		l := int(f[offset])
+		if f[offset+1] != 0x03 || l < 2 || l%2 != 0 || offset+l > len(f) {
+			break
+		}
+
+		chars := make([]uint16, (l-2)/2)
+		for i := range chars {
+			chars[i] = binary.LittleEndian.Uint16(f[offset+2+2*i:])
+		}
+
+		result = append(result, USBString{
+			Index:  index,
+			Offset: offset,
+			Value:  string(utf16.Decode(chars)),
+		})
+		offset += l
+	}
+
+	return result
+}
+
+func parseConfiguration(id *USBIdentity, f []byte) {
+	start := -1
+	for i := 0; i+9 <= len(f); i++ {
+		if f[i] == 0x09 && f[i+1] == 0x02 && f[i+5] > 0 && int(binary.LittleEndian.Uint16(f[i+2:])) > 9 {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return
+	}
+
+	id.IConfiguration = int(f[start+6])
+
+	end := start + int(binary.LittleEndian.Uint16(f[start+2:]))
+	if end > len(f) {
+		end = len(f)
+	}
+
+	var class byte
+	for offset := start; offset+2 <= end; {
+		l := int(f[offset])
+		if l < 2 || offset+l > end {
+			break
+		}
+		d := f[offset : offset+l]
+
+		if d[1] == 0x04 && l >= 9 {
+			class = d[5]
+			id.Interfaces = append(id.Interfaces, USBInterface{
+				Offset:    offset,
+				Number:    int(d[2]),
+				Alternate: int(d[3]),
+				Class:     d[5],
+				SubClass:  d[6],
+				IName:     int(d[8]),
+			})
+		} else if d[1] == 0x24 && class == 0x0e && l >= 9 && (d[2] == 0x05 || d[2] == 0x07) {
+			format := "YUV"
+			if d[2] == 0x07 {
+				format = "MJPEG"
+			}
+			id.Frames = append(id.Frames, USBFrame{
+				Offset: offset,
+				Format: format,
+				Width:  int(binary.LittleEndian.Uint16(d[5:])),
+				Height: int(binary.LittleEndian.Uint16(d[7:])),
+			})
+		}
+
+		offset += l
+	}
+}
+
+/* FindUSBIdentity searches an EEPROM image for the USB descriptors used by the firmware */
+func FindUSBIdentity(f []byte) *USBIdentity {
+	id := &USBIdentity{
+		DeviceOffset: -1,
+	}
+
+	for i := 0; i+18 <= len(f); i++ {
+		if !isDeviceDescriptor(f[i:]) {
+			continue
+		}
+
+		if id.DeviceOffset >= 0 {
+			id.Alternates = append(id.Alternates, USBDevice{
+				Offset:    i,
+				VID:       binary.LittleEndian.Uint16(f[i+8:]),
+				PID:       binary.LittleEndian.Uint16(f[i+10:]),
+				BCDDevice: binary.LittleEndian.Uint16(f[i+12:]),
+			})
+		} else {
+			id.DeviceOffset = i
+			id.VID = binary.LittleEndian.Uint16(f[i+8:])
+			id.PID = binary.LittleEndian.Uint16(f[i+10:])
+			id.BCDDevice = binary.LittleEndian.Uint16(f[i+12:])
+			id.IManufacturer = int(f[i+14])
+			id.IProduct = int(f[i+15])
+			id.ISerial = int(f[i+16])
+		}
+		i += 17
+	}
+
+	id.Strings = parseStrings(f)
+	parseConfiguration(id, f)
+
+	return id
+}
+
+func (id *USBIdentity) SetIDs(f []byte, vid uint16, pid uint16) error {
+	if id.DeviceOffset < 0 {
+		return errors.New("device descriptor not found")
+	}
+
+	binary.LittleEndian.PutUint16(f[id.DeviceOffset+8:], vid)
+	binary.LittleEndian.PutUint16(f[id.DeviceOffset+10:], pid)
+	id.VID = vid
+	id.PID = pid
+	return nil
+}
+
+/* SetAlternateIDs changes the IDs of the n-th further device descriptor */
+func (id *USBIdentity) SetAlternateIDs(f []byte, n int, vid uint16, pid uint16) error {
+	if n < 0 || n >= len(id.Alternates) {
+		return fmt.Errorf("device descriptor %d not found, the firmware has %d", n+2, len(id.Alternates)+1)
+	}
+
+	d := &id.Alternates[n]
+	binary.LittleEndian.PutUint16(f[d.Offset+8:], vid)
+	binary.LittleEndian.PutUint16(f[d.Offset+10:], pid)
+	d.VID = vid
+	d.PID = pid
+	return nil
+}
+
+/* markAll takes every byte of a descriptor from the given offset as a string index */
+func markAll(used map[int]bool, d []byte, from int) {
+	for _, m := range d[from:] {
+		used[int(m)] = true
+	}
+}
+
+/* configStrings adds the string indices referenced by the configuration descriptor set at start.
+ * Descriptors whose string fields are not known have all their bytes taken as indices. */
+func configStrings(used map[int]bool, f []byte, start int) {
+	end := start + int(binary.LittleEndian.Uint16(f[start+2:]))
+	if end > len(f) {
+		end = len(f)
+	}
+
+	var class, subClass byte
+	for offset := start; offset+2 <= end; {
+		l := int(f[offset])
+		if l < 2 || offset+l > end {
+			break
+		}
+		d := f[offset : offset+l]
+		offset += l
+
+		switch d[1] {
+		case 0x02, 0x07: /* Configuration, other speed configuration */
+			if l >= 9 {
+				used[int(d[6])] = true
+			}
+		case 0x04: /* Interface */
+			if l >= 9 {
+				class, subClass = d[5], d[6]
+				used[int(d[8])] = true
+			}
+		case 0x0b: /* Interface association */
+			if l >= 8 {
+				used[int(d[7])] = true
+			}
+		case 0x05, 0x21, 0x25: /* Endpoint, HID, class specific endpoint */
+		case 0x24: /* Class specific interface */
+			if (class == 0x01 || class == 0x0e) && subClass == 0x02 {
+				/* Streaming interfaces don't refer to strings */
+			} else if l < 4 {
+				markAll(used, d, 2)
+			} else if class == 0x0e && subClass == 0x01 {
+				videoControlStrings(used, d)
+			} else if class == 0x01 && subClass == 0x01 {
+				audioControlStrings(used, d)
+			} else {
+				markAll(used, d, 2)
+			}
+		default:
+			markAll(used, d, 2)
+		}
+	}
+}
+
+func videoControlStrings(used map[int]bool, d []byte) {
+	switch {
+	case d[2] == 0x01: /* Header */
+	case d[2] == 0x02 && len(d) >= 8: /* Input terminal */
+		used[int(d[7])] = true
+	case d[2] == 0x03 && len(d) >= 9: /* Output terminal */
+		used[int(d[8])] = true
+	case d[2] == 0x04 || d[2] == 0x06: /* Selector and extension units end with their string */
+		used[int(d[len(d)-1])] = true
+	default:
+		markAll(used, d, 3)
+	}
+}
+
+func audioControlStrings(used map[int]bool, d []byte) {
+	switch {
+	case d[2] == 0x01: /* Header */
+	case d[2] == 0x02 && len(d) >= 12: /* Input terminal */
+		used[int(d[10])] = true
+		used[int(d[11])] = true
+	case d[2] == 0x03 && len(d) >= 9: /* Output terminal */
+		used[int(d[8])] = true
+	case d[2] == 0x05 || d[2] == 0x06: /* Selector and feature units end with their string */
+		used[int(d[len(d)-1])] = true
+	default:
+		markAll(used, d, 3)
+	}
+}
+
+/* UsedStrings returns the string indices referenced by the device descriptors and by every
+ * configuration descriptor set in the image */
+func (id *USBIdentity) UsedStrings(f []byte) map[int]bool {
+	used := map[int]bool{}
+
+	offsets := []int{id.DeviceOffset}
+	for _, m := range id.Alternates {
+		offsets = append(offsets, m.Offset)
+	}
+	for _, m := range offsets {
+		if m >= 0 {
+			used[int(f[m+14])] = true
+			used[int(f[m+15])] = true
+			used[int(f[m+16])] = true
+		}
+	}
+
+	for i := 0; i+9 <= len(f); i++ {
+		if f[i] == 0x09 && (f[i+1] == 0x02 || f[i+1] == 0x07) && f[i+5] > 0 && int(binary.LittleEndian.Uint16(f[i+2:])) > 9 {
+			configStrings(used, f, i)
+		}
+	}
+
+	delete(used, 0)
+	return used
+}
+
+/* AssignSerial points iSerial at a string, as the string table can't grow. With index 0 it takes a
+ * string that no descriptor in the image refers to. It returns the index of that string. */
+func (id *USBIdentity) AssignSerial(f []byte, index int) (int, error) {
+	if id.ISerial != 0 {
+		return id.ISerial, nil
+	}
+	if id.DeviceOffset < 0 {
+		return 0, errors.New("device descriptor not found")
+	}
+
+	if index == 0 {
+		used := id.UsedStrings(f)
+		for _, m := range id.Strings {
+			if !used[m.Index] {
+				index = m.Index
+				break
+			}
+		}
+		if index == 0 {
+			return 0, errors.New("firmware has no serial number string and every string is referenced by a descriptor")
+		}
+	} else if id.String(index) == nil {
+		return 0, fmt.Errorf("string descriptor %d not found", index)
+	}
+
+	f[id.DeviceOffset+16] = byte(index)
+	id.ISerial = index
+	return index, nil
+}
+
+/* SetString replaces a string in place. Shorter values are padded with spaces, since the
+ * firmware finds strings by walking the table and the descriptor length can't change. */
+func (id *USBIdentity) SetString(f []byte, index int, value string) error {
+	s := id.String(index)
+	if s == nil {
+		return fmt.Errorf("string descriptor %d not found", index)
+	}
+
+	chars := utf16.Encode([]rune(value))
+	if len(chars) > s.MaxLen() {
+		return fmt.Errorf("string %q is longer than the %d characters available", value, s.MaxLen())
+	}
+	for len(chars) < s.MaxLen() {
+		chars = append(chars, ' ')
+	}
+
+	for i, m := range chars {
+		binary.LittleEndian.PutUint16(f[s.Offset+2+2*i:], m)
+	}
+	s.Value = string(utf16.Decode(chars))
+	return nil
+}
@@ -0,0 +1,132 @@
+package mseeprom
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func usbString(s string) []byte {
+	d := []byte{byte(2 + 2*len(s)), 0x03}
+	for _, m := range s {
+		d = append(d, byte(m), 0)
+	}
+	return d
+}
+
+/* usbTestImage has a device descriptor, a video function with one frame and four strings, the last
+ * of which no descriptor refers to. It returns the offsets of the parts. */
+func usbTestImage() ([]byte, map[string]int) {
+	device := []byte{0x12, 0x01, 0x00, 0x02, 0xef, 0x02, 0x01, 0x40, 0x5d, 0x53, 0x09, 0x21, 0x00, 0x01, 0x01, 0x02, 0x00, 0x01}
+
+	config := []byte{0x09, 0x02, 0, 0, 0x02, 0x01, 0x00, 0x80, 0xfa}
+	vcInterface := []byte{0x09, 0x04, 0x00, 0x00, 0x01, 0x0e, 0x01, 0x00, 0x03}
+	inputTerminal := []byte{0x08, 0x24, 0x02, 0x01, 0x01, 0x02, 0x00, 0x00}
+	vsInterface := []byte{0x09, 0x04, 0x01, 0x00, 0x00, 0x0e, 0x02, 0x00, 0x00}
+	frame := []byte{0x0e, 0x24, 0x05, 0x01, 0x00, 0x80, 0x07, 0x38, 0x04, 0, 0, 0, 0, 0}
+
+	offsets := map[string]int{}
+	var f []byte
+	add := func(name string, d []byte) {
+		offsets[name] = len(f)
+		f = append(f, d...)
+	}
+
+	add("device", device)
+	add("config", config)
+	add("vcInterface", vcInterface)
+	add("inputTerminal", inputTerminal)
+	add("vsInterface", vsInterface)
+	add("frame", frame)
+	binary.LittleEndian.PutUint16(f[offsets["config"]+2:], uint16(len(f)-offsets["config"]))
+
+	add("strings", []byte{0x04, 0x03, 0x09, 0x04})
+	add("manufacturer", usbString("MS"))
+	add("product", usbString("Cam"))
+	add("interface", usbString("Video"))
+	add("spare", usbString("0000"))
+	add("end", nil)
+
+	return f, offsets
+}
+
+func TestUSBIdentityTruncated(t *testing.T) {
+	f, offsets := usbTestImage()
+
+	tests := []struct {
+		name       string
+		length     int
+		strings    int
+		interfaces int
+		frames     int
+		used       []int
+		serial     int /* 0 if no string is free */
+	}{
+		{"complete", offsets["end"], 4, 2, 1, []int{1, 2, 3}, 4},
+		{"last string cut", offsets["end"] - 1, 3, 2, 1, []int{1, 2, 3}, 0},
+		{"string table cut after its header", offsets["strings"] + 5, 0, 2, 1, []int{1, 2, 3}, 0},
+		{"frame cut", offsets["frame"] + 9, 0, 2, 0, []int{1, 2, 3}, 0},
+		{"interface cut", offsets["vcInterface"] + 5, 0, 0, 0, []int{1, 2}, 0},
+		{"configuration header only", offsets["config"] + 9, 0, 0, 0, []int{1, 2}, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			img := append([]byte{}, f[:tc.length]...)
+			id := FindUSBIdentity(img)
+
+			if id.DeviceOffset != 0 || id.VID != 0x535d || id.PID != 0x2109 {
+				t.Errorf("device descriptor at %d, %04x:%04x", id.DeviceOffset, id.VID, id.PID)
+			}
+			if len(id.Strings) != tc.strings || len(id.Interfaces) != tc.interfaces || len(id.Frames) != tc.frames {
+				t.Errorf("%d strings, %d interfaces, %d frames, expected %d, %d and %d",
+					len(id.Strings), len(id.Interfaces), len(id.Frames), tc.strings, tc.interfaces, tc.frames)
+			}
+
+			used := id.UsedStrings(img)
+			if len(used) != len(tc.used) {
+				t.Errorf("used strings %v, expected %v", used, tc.used)
+			}
+			for _, m := range tc.used {
+				if !used[m] {
+					t.Errorf("string %d not marked as used", m)
+				}
+			}
+
+			serial, err := id.AssignSerial(img, 0)
+			if tc.serial == 0 {
+				if err == nil {
+					t.Errorf("took string %d for the serial number, expected an error", serial)
+				}
+				return
+			}
+			if err != nil || serial != tc.serial || int(img[16]) != tc.serial {
+				t.Errorf("serial string %d (%v), descriptor %d, expected %d", serial, err, img[16], tc.serial)
+			}
+		})
+	}
+
+	/* No length may make the walkers read outside of the image */
+	for n := 0; n <= len(f); n++ {
+		img := append([]byte{}, f[:n]...)
+		id := FindUSBIdentity(img)
+		id.UsedStrings(img)
+		id.AssignSerial(img, 0)
+	}
+}
+
+func TestSetStringPadding(t *testing.T) {
+	f, _ := usbTestImage()
+	id := FindUSBIdentity(f)
+
+	if err := id.SetString(f, 2, "TV"); err != nil {
+		t.Fatal(err)
+	}
+	if got := FindUSBIdentity(f).String(2).Value; got != "TV " {
+		t.Errorf("string is %q, expected it padded to %q", got, "TV ")
+	}
+
+	if err := id.SetString(f, 2, "Long"); err == nil || !strings.Contains(err.Error(), "longer") {
+		t.Errorf("expected an error for a longer string, got %v", err)
+	}
+}
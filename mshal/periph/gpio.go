@@ -0,0 +1,139 @@
+//go:build periph
+// +build periph
+
+package periph
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/johnneerdael/ms-tools/mshal"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/physic"
+)
+
+/* Pins that the firmware uses for something else, by chip */
+var pinFunctions = map[string]map[int]string{
+	"MS2107": {4: "EEPROM_WP"},
+	"MS2109": {5: "EEPROM_WP"},
+}
+
+/* Pin implements gpio.PinIO for one of the eight GPIOs (port P2) of the chip. Edges are
+ * detected by polling the pin. */
+type Pin struct {
+	hal   *mshal.HAL
+	index int
+	edge  gpio.Edge
+}
+
+var _ gpio.PinIO = (*Pin)(nil)
+
+func NewPin(h *mshal.HAL, index int) (*Pin, error) {
+	if index < 0 || index > 7 {
+		return nil, fmt.Errorf("periph: GPIO %d does not exist", index)
+	}
+	return &Pin{hal: h, index: index}, nil
+}
+
+/* Pins returns all GPIOs of the chip */
+func Pins(h *mshal.HAL) []*Pin {
+	var pins []*Pin
+	for i := 0; i < 8; i++ {
+		pins = append(pins, &Pin{hal: h, index: i})
+	}
+	return pins
+}
+
+func (p *Pin) String() string {
+	return p.hal.GetDeviceType() + "/" + p.Name()
+}
+
+func (p *Pin) Halt() error {
+	p.edge = gpio.NoEdge
+	return nil
+}
+
+func (p *Pin) Name() string {
+	return fmt.Sprintf("P2.%d", p.index)
+}
+
+func (p *Pin) Number() int {
+	return p.index
+}
+
+func (p *Pin) Function() string {
+	if name, ok := pinFunctions[p.hal.GetDeviceType()][p.index]; ok {
+		return name
+	}
+
+	value, isOutput, err := p.hal.GPIOUpdate(0, 0, 0, 0)
+	if err != nil {
+		return "ERR"
+	}
+
+	level := gpio.Level(value&(1<<p.index) > 0)
+	if isOutput&(1<<p.index) > 0 {
+		return "Out/" + level.String()
+	}
+	return "In/" + level.String()
+}
+
+func (p *Pin) In(pull gpio.Pull, edge gpio.Edge) error {
+	if pull != gpio.PullNoChange && pull != gpio.Float {
+		return errors.New("periph: pull resistors are not supported")
+	}
+
+	p.edge = edge
+	_, err := p.hal.GPIORead(p.index)
+	return err
+}
+
+/* Read returns Low if the pin can't be read, as gpio.PinIn has no way to report errors */
+func (p *Pin) Read() gpio.Level {
+	value, err := p.hal.GPIORead(p.index)
+	if err != nil {
+		return gpio.Low
+	}
+	return gpio.Level(value)
+}
+
+func (p *Pin) WaitForEdge(timeout time.Duration) bool {
+	if p.edge == gpio.NoEdge {
+		return false
+	}
+
+	start := time.Now()
+	last := p.Read()
+	for timeout < 0 || time.Since(start) < timeout {
+		time.Sleep(time.Millisecond)
+
+		level := p.Read()
+		if level == last {
+			continue
+		}
+		last = level
+
+		if p.edge == gpio.BothEdges || (p.edge == gpio.RisingEdge) == bool(level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Pin) Pull() gpio.Pull {
+	return gpio.PullNoChange
+}
+
+func (p *Pin) DefaultPull() gpio.Pull {
+	return gpio.PullNoChange
+}
+
+func (p *Pin) Out(l gpio.Level) error {
+	return p.hal.GPIOWrite(p.index, bool(l))
+}
+
+func (p *Pin) PWM(duty gpio.Duty, f physic.Frequency) error {
+	return errors.New("periph: PWM is not supported")
+}
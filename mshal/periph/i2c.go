@@ -0,0 +1,56 @@
+//go:build periph
+// +build periph
+
+/* Package periph adapts the I2C bus and GPIO pins of a MacroSilicon chip to the periph.io
+ * interfaces, so existing periph device drivers can be used over the USB HID interface. The
+ * package is only built with the 'periph' build tag. */
+package periph
+
+import (
+	"fmt"
+
+	"github.com/johnneerdael/ms-tools/mshal"
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/physic"
+)
+
+/* Bus implements i2c.Bus on top of HAL.I2CTransferMessages. Like the HAL itself, it must not be used
+ * from multiple goroutines at the same time. */
+type Bus struct {
+	hal *mshal.HAL
+}
+
+var _ i2c.Bus = (*Bus)(nil)
+
+func NewBus(h *mshal.HAL) *Bus {
+	return &Bus{hal: h}
+}
+
+func (b *Bus) String() string {
+	return b.hal.GetDeviceType() + "/I2C"
+}
+
+func (b *Bus) Tx(addr uint16, w, r []byte) error {
+	if addr > 0x7f {
+		return fmt.Errorf("periph: 10-bit I2C address %#x is not supported", addr)
+	}
+
+	/* A NACK is returned as *mshal.I2CNackError, which tells the byte that was not acknowledged */
+	var msgs []mshal.I2CMessage
+	if len(w) > 0 || len(r) == 0 {
+		msgs = append(msgs, mshal.I2CMessage{Addr: uint8(addr), Data: w})
+	}
+	if len(r) > 0 {
+		msgs = append(msgs, mshal.I2CMessage{Addr: uint8(addr), Read: true, Data: r})
+	}
+	return b.hal.I2CTransferMessages(msgs, false)
+}
+
+/* SetSpeed only works when the HAL bit-bangs the bus, see HALConfig.I2CSpeed */
+func (b *Bus) SetSpeed(f physic.Frequency) error {
+	return b.hal.I2CSetSpeed(int(f / physic.Hertz))
+}
+
+func (b *Bus) Close() error {
+	return nil
+}
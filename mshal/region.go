@@ -10,6 +10,18 @@ type MemoryRegion interface {
 	GetAlignment() int
 }
 
+/* Regions that are written in pages larger than their alignment implement this */
+type MemoryRegionPaged interface {
+	GetPageSize() int
+}
+
+func RegionPageSize(m MemoryRegion) int {
+	if p, ok := m.(MemoryRegionPaged); ok {
+		return p.GetPageSize()
+	}
+	return m.GetAlignment()
+}
+
 type regionCompleteIO struct {
 	MemoryRegion
 }
@@ -20,6 +32,15 @@ func regionWrapCompleteIO(parent MemoryRegion) MemoryRegion {
 	}
 }
 
+/* RegionWrapCompleteIO repeats partial accesses of parent until the whole buffer is transferred */
+func RegionWrapCompleteIO(parent MemoryRegion) MemoryRegion {
+	return regionWrapCompleteIO(parent)
+}
+
+func (m regionCompleteIO) GetPageSize() int {
+	return RegionPageSize(m.MemoryRegion)
+}
+
 func (m regionCompleteIO) Access(write bool, addr int, buf []byte) (int, error) {
 	align := m.GetAlignment()
 	if addr&(align-1) != 0 {
@@ -85,6 +106,10 @@ func (h regionPartial) GetAlignment() int {
 	return h.parent.GetAlignment()
 }
 
+func (h regionPartial) GetPageSize() int {
+	return RegionPageSize(h.parent)
+}
+
 func (h regionPartial) Access(write bool, addr int, buf []byte) (int, error) {
 	if len(buf)+addr > h.length {
 		if addr > h.length {
@@ -109,3 +134,42 @@ func RecursiveGetParentAddress(region MemoryRegion, offset int) (MemoryRegion, i
 		}
 	}
 }
+
+type regionBuffer struct {
+	name MemoryRegionNameType
+	data []byte
+}
+
+func regionWrapBuffer(name MemoryRegionNameType, data []byte) MemoryRegion {
+	return regionBuffer{
+		name: name,
+		data: data,
+	}
+}
+
+func (h regionBuffer) GetName() MemoryRegionNameType {
+	return h.name
+}
+
+func (h regionBuffer) GetLength() int {
+	return len(h.data)
+}
+
+func (h regionBuffer) GetParent() (MemoryRegion, int) {
+	return nil, 0
+}
+
+func (h regionBuffer) GetAlignment() int {
+	return 1
+}
+
+func (h regionBuffer) Access(write bool, addr int, buf []byte) (int, error) {
+	if addr > len(h.data) {
+		return 0, nil
+	}
+
+	if write {
+		return copy(h.data[addr:], buf), nil
+	}
+	return copy(buf, h.data[addr:]), nil
+}
@@ -0,0 +1,92 @@
+package mshal
+
+import (
+	"bytes"
+	"io"
+)
+
+type DiffWriteStats struct {
+	Written int
+	Skipped int
+}
+
+type regionDiffWrite struct {
+	MemoryRegion
+	stats *DiffWriteStats
+}
+
+/* RegionWrapDiffWrite returns a region that reads the current contents before writing and only
+ * writes the pages that differ. The number of bytes written and skipped is added to stats, if not nil. */
+func RegionWrapDiffWrite(parent MemoryRegion, stats *DiffWriteStats) MemoryRegion {
+	return regionDiffWrite{
+		MemoryRegion: parent,
+		stats:        stats,
+	}
+}
+
+func (m regionDiffWrite) GetPageSize() int {
+	return RegionPageSize(m.MemoryRegion)
+}
+
+func (m regionDiffWrite) Access(write bool, addr int, buf []byte) (int, error) {
+	if !write {
+		return m.MemoryRegion.Access(false, addr, buf)
+	}
+
+	if addr > m.GetLength() {
+		return 0, nil
+	}
+	if addr+len(buf) > m.GetLength() {
+		buf = buf[:m.GetLength()-addr]
+	}
+
+	current := make([]byte, len(buf))
+	n, err := m.MemoryRegion.Access(false, addr, current)
+	if err != nil {
+		return 0, err
+	}
+
+	/* Consecutive pages that changed are written together. If a write fails or is cut short,
+	 * everything before the point where it stopped has been written or was already equal. */
+	page := m.GetPageSize()
+	runStart := -1
+	flush := func(end int) (int, error) {
+		if runStart < 0 {
+			return end, nil
+		}
+		written, err := m.MemoryRegion.Access(true, addr+runStart, buf[runStart:end])
+		if m.stats != nil {
+			m.stats.Written += written
+		}
+		if err == nil && written < end-runStart {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return runStart + written, err
+		}
+		runStart = -1
+		return end, nil
+	}
+
+	for offset := 0; offset < len(buf); {
+		end := (addr+offset)/page*page + page - addr
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		if end <= n && bytes.Equal(buf[offset:end], current[offset:end]) {
+			if done, err := flush(offset); err != nil {
+				return done, err
+			}
+			if m.stats != nil {
+				m.stats.Skipped += end - offset
+			}
+		} else if runStart < 0 {
+			runStart = offset
+		}
+
+		offset = end
+	}
+
+	return flush(len(buf))
+}
@@ -0,0 +1,212 @@
+/* Package sfdp identifies SPI NOR flashes by their JEDEC ID and SFDP tables (JESD216) */
+package sfdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+type EraseType struct {
+	Size   int
+	Opcode byte
+}
+
+/* Geometry describes the layout of a flash, erase types are sorted from small to large */
+type Geometry struct {
+	Size       int
+	PageSize   int
+	AddrBytes  int
+	EraseTypes []EraseType
+	FromSFDP   bool
+}
+
+var ErrorNoSFDP = errors.New("flash does not have SFDP tables")
+
+/* Most parts encode the capacity as a power of two in the last byte of the JEDEC ID */
+func FromJEDEC(id [3]byte) (Geometry, error) {
+	g := Geometry{
+		PageSize:   256,
+		AddrBytes:  3,
+		EraseTypes: []EraseType{{4096, 0x20}, {32768, 0x52}, {65536, 0xd8}},
+	}
+
+	if id[2] >= 0x10 && id[2] <= 0x1f {
+		g.Size = 1 << id[2]
+	} else if id[2] >= 0x20 && id[2] <= 0x22 {
+		/* Micron continues at 64MB with 0x20 */
+		g.Size = 1 << (id[2] - 6)
+	} else {
+		return g, errors.New("unknown flash capacity")
+	}
+
+	if g.Size > 1<<24 {
+		g.AddrBytes = 4
+	}
+	return g, nil
+}
+
+/* Parse reads the JEDEC basic flash parameter table using read */
+func Parse(read func(addr int, buf []byte) error) (Geometry, error) {
+	var g Geometry
+
+	var header [8]byte
+	if err := read(0, header[:]); err != nil {
+		return g, err
+	}
+	if string(header[:4]) != "SFDP" {
+		return g, ErrorNoSFDP
+	}
+
+	/* Find the basic flash parameter table, its ID is 0xFF00 */
+	var bfpt []byte
+	for i := 0; i <= int(header[6]); i++ {
+		var param [8]byte
+		if err := read(8+8*i, param[:]); err != nil {
+			return g, err
+		}
+		if param[0] != 0x00 || param[7] != 0xff {
+			continue
+		}
+
+		dwords := int(param[3])
+		if dwords > 16 {
+			dwords = 16
+		}
+		if dwords < 2 {
+			return g, errors.New("SFDP basic flash parameter table is too short")
+		}
+
+		ptr := int(param[4]) | int(param[5])<<8 | int(param[6])<<16
+		bfpt = make([]byte, 4*dwords)
+		if err := read(ptr, bfpt); err != nil {
+			return g, err
+		}
+		break
+	}
+	if bfpt == nil {
+		return g, errors.New("SFDP basic flash parameter table not found")
+	}
+
+	dword := func(n int) (uint32, bool) {
+		if 4*n+4 > len(bfpt) {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint32(bfpt[4*n:]), true
+	}
+
+	dw1, _ := dword(0)
+	dw2, _ := dword(1)
+
+	/* Density is in bits, large parts give it as a power of two */
+	if dw2&0x80000000 != 0 {
+		g.Size = int((uint64(1) << (dw2 & 0x7fffffff)) / 8)
+	} else {
+		g.Size = int((uint64(dw2) + 1) / 8)
+	}
+
+	g.AddrBytes = 3
+	if addr := (dw1 >> 17) & 3; addr == 2 || (addr == 1 && g.Size > 1<<24) {
+		g.AddrBytes = 4
+	}
+
+	/* Erase types 1-4 are in DWORD 8 and 9 */
+	for n := 7; n <= 8; n++ {
+		dw, ok := dword(n)
+		if !ok {
+			break
+		}
+		for i := 0; i < 2; i++ {
+			if exp := byte(dw >> (16 * i)); exp != 0 {
+				g.EraseTypes = append(g.EraseTypes, EraseType{Size: 1 << exp, Opcode: byte(dw >> (16*i + 8))})
+			}
+		}
+	}
+	if len(g.EraseTypes) == 0 && dw1&3 == 1 {
+		g.EraseTypes = append(g.EraseTypes, EraseType{Size: 4096, Opcode: byte(dw1 >> 8)})
+	}
+	sort.Slice(g.EraseTypes, func(i, j int) bool {
+		return g.EraseTypes[i].Size < g.EraseTypes[j].Size
+	})
+
+	g.PageSize = 256
+	if dw11, ok := dword(10); ok && (dw11>>4)&0xf != 0 {
+		g.PageSize = 1 << ((dw11 >> 4) & 0xf)
+	}
+
+	g.FromSFDP = true
+	return g, nil
+}
+
+const (
+	cmdReadJEDEC = 0x9f
+	cmdReadSFDP  = 0x5a
+)
+
+var manufacturers = map[byte]string{
+	0x01: "Spansion/Cypress",
+	0x0b: "XTX",
+	0x1c: "EON",
+	0x1f: "Adesto",
+	0x20: "Micron/XMC",
+	0x5e: "Zbit",
+	0x68: "Boya",
+	0x85: "Puya",
+	0x9d: "ISSI",
+	0xbf: "SST",
+	0xc2: "Macronix",
+	0xc8: "GigaDevice",
+	0xef: "Winbond",
+}
+
+type Info struct {
+	JEDEC [3]byte
+	Geometry
+}
+
+/* Command sends tx to the flash with chip select asserted and returns the rxLen bytes that follow */
+type Command func(tx []byte, rxLen int) ([]byte, error)
+
+/* Identify reads the JEDEC ID and the geometry from SFDP, falling back to the JEDEC ID */
+func Identify(cmd Command) (Info, error) {
+	var info Info
+
+	id, err := cmd([]byte{cmdReadJEDEC}, 3)
+	if err != nil {
+		return info, err
+	}
+	copy(info.JEDEC[:], id)
+
+	if info.JEDEC == [3]byte{0, 0, 0} || info.JEDEC == [3]byte{0xff, 0xff, 0xff} {
+		return info, errors.New("no SPI flash found")
+	}
+
+	/* SFDP is always read with a 3 byte address and a dummy byte */
+	read := func(addr int, buf []byte) error {
+		rx, err := cmd([]byte{cmdReadSFDP, byte(addr >> 16), byte(addr >> 8), byte(addr), 0}, len(buf))
+		copy(buf, rx)
+		return err
+	}
+
+	info.Geometry, err = Parse(read)
+	if err != nil {
+		info.Geometry, err = FromJEDEC(info.JEDEC)
+	}
+	return info, err
+}
+
+func (i Info) Manufacturer() string {
+	if name, ok := manufacturers[i.JEDEC[0]]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (i Info) String() string {
+	source := "JEDEC ID"
+	if i.FromSFDP {
+		source = "SFDP"
+	}
+	return fmt.Sprintf("%s %02x%02x%02x, %d bytes (%s), %d byte pages, %d byte addresses", i.Manufacturer(), i.JEDEC[0], i.JEDEC[1], i.JEDEC[2], i.Size, source, i.PageSize, i.AddrBytes)
+}
@@ -0,0 +1,116 @@
+package sfdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/* makeSFDP builds an SFDP area with one basic flash parameter table at 0x30 */
+func makeSFDP(bfpt ...uint32) []byte {
+	f := make([]byte, 0x30+4*len(bfpt))
+	copy(f, "SFDP")
+	f[4], f[5], f[6], f[7] = 0x06, 0x01, 0, 0xff
+	copy(f[8:], []byte{0x00, 0x06, 0x01, byte(len(bfpt)), 0x30, 0x00, 0x00, 0xff})
+	for i, m := range bfpt {
+		binary.LittleEndian.PutUint32(f[0x30+4*i:], m)
+	}
+	return f
+}
+
+func readFrom(f []byte) func(addr int, buf []byte) error {
+	return func(addr int, buf []byte) error {
+		if addr+len(buf) > len(f) {
+			return errors.New("read outside of the SFDP area")
+		}
+		copy(buf, f[addr:])
+		return nil
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		sfdp []byte
+		want Geometry
+		err  string
+	}{
+		{
+			name: "16Mbit with 4KB, 32KB and 64KB erase",
+			sfdp: makeSFDP(0xfff120e5, 0x00ffffff, 0, 0, 0, 0, 0, 0x520f200c, 0x0000d810, 0, 0x00000081),
+			want: Geometry{Size: 2 << 20, PageSize: 256, AddrBytes: 3, EraseTypes: []EraseType{{4096, 0x20}, {32768, 0x52}, {65536, 0xd8}}, FromSFDP: true},
+		},
+		{
+			name: "8Gbit density as power of two",
+			sfdp: makeSFDP(0xfff320e5, 0x80000021, 0, 0, 0, 0, 0, 0x0000200c),
+			want: Geometry{Size: 1 << 30, PageSize: 256, AddrBytes: 4, EraseTypes: []EraseType{{4096, 0x20}}, FromSFDP: true},
+		},
+		{
+			name: "no 4KB erase",
+			sfdp: makeSFDP(0xffffffe7, 0x01ffffff, 0, 0, 0, 0, 0, 0x0000d810, 0),
+			want: Geometry{Size: 4 << 20, PageSize: 256, AddrBytes: 3, EraseTypes: []EraseType{{65536, 0xd8}}, FromSFDP: true},
+		},
+		{
+			name: "JESD216 rev 0 table, 4KB erase from DWORD 1 only",
+			sfdp: makeSFDP(0xfff120e5, 0x003fffff),
+			want: Geometry{Size: 512 << 10, PageSize: 256, AddrBytes: 3, EraseTypes: []EraseType{{4096, 0x20}}, FromSFDP: true},
+		},
+		{
+			name: "table too short",
+			sfdp: makeSFDP(0xfff120e5),
+			err:  "too short",
+		},
+		{
+			name: "no SFDP signature",
+			sfdp: make([]byte, 16),
+			err:  ErrorNoSFDP.Error(),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			g, err := Parse(readFrom(tc.sfdp))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(g, tc.want) {
+				t.Errorf("got %+v, expected %+v", g, tc.want)
+			}
+		})
+	}
+}
+
+func TestFromJEDEC(t *testing.T) {
+	tests := []struct {
+		id        [3]byte
+		size      int
+		addrBytes int
+	}{
+		{[3]byte{0xef, 0x40, 0x16}, 4 << 20, 3},
+		{[3]byte{0xc8, 0x40, 0x18}, 16 << 20, 3},
+		{[3]byte{0x20, 0xba, 0x20}, 64 << 20, 4},
+	}
+
+	for _, tc := range tests {
+		g, err := FromJEDEC(tc.id)
+		if err != nil {
+			t.Errorf("%x: %v", tc.id, err)
+			continue
+		}
+		if g.Size != tc.size || g.AddrBytes != tc.addrBytes {
+			t.Errorf("%x: %d bytes, %d address bytes, expected %d and %d", tc.id, g.Size, g.AddrBytes, tc.size, tc.addrBytes)
+		}
+	}
+
+	if _, err := FromJEDEC([3]byte{0xef, 0x40, 0x05}); err == nil {
+		t.Error("expected an error for an unknown capacity")
+	}
+}
@@ -0,0 +1,358 @@
+/* Package spinor drives SPI NOR flashes (W25Qxx and compatible) over an SPI transfer function,
+ * such as the bit-banged SPI master of the HAL. */
+package spinor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/johnneerdael/ms-tools/mshal"
+	"github.com/johnneerdael/ms-tools/mshal/sfdp"
+)
+
+/* Transport performs a transfer with chip select asserted, see mshal.HAL.SPITransfer */
+type Transport interface {
+	SPITransfer(mode int, tx []byte, rxLen int) ([]byte, error)
+}
+
+const (
+	cmdReadStatus  = 0x05
+	cmdWriteStatus = 0x01
+	cmdWriteEnable = 0x06
+	cmdFastRead    = 0x0b
+	cmdPageProgram = 0x02
+	cmdChipErase   = 0xc7
+)
+
+/* Opcodes that take a 4 byte address, for parts larger than 16MB */
+var cmd4ByteAddr = map[byte]byte{
+	cmdFastRead:    0x0c,
+	cmdPageProgram: 0x12,
+	0x20:           0x21,
+	0x52:           0x5c,
+	0xd8:           0xdc,
+}
+
+const (
+	statusBusy         = 1 << 0
+	statusWriteEnabled = 1 << 1
+	statusProtect      = 0x7c /* BP0-BP2, TB and SEC on most parts */
+)
+
+/* Reads and erases are limited so a single access does not block for too long */
+const maxReadLen = 4096
+
+type Flash struct {
+	t    Transport
+	mode int
+
+	sfdp.Info
+
+	ProgramTimeout time.Duration
+	EraseTimeout   time.Duration /* Per 64KB */
+}
+
+/* New identifies the flash and reads its geometry from SFDP, falling back to the JEDEC ID */
+func New(t Transport) (*Flash, error) {
+	f := &Flash{
+		t: t,
+
+		ProgramTimeout: 50 * time.Millisecond,
+		EraseTimeout:   3 * time.Second,
+	}
+
+	var err error
+	if f.Info, err = sfdp.Identify(f.cmd); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *Flash) cmd(tx []byte, rxLen int) ([]byte, error) {
+	rx, err := f.t.SPITransfer(f.mode, tx, rxLen)
+	if err != nil {
+		return nil, err
+	}
+	return rx[len(tx):], nil
+}
+
+func (f *Flash) addrCmd(op byte, addr int, extra ...byte) ([]byte, error) {
+	if f.AddrBytes == 4 {
+		op4, ok := cmd4ByteAddr[op]
+		if !ok {
+			return nil, fmt.Errorf("no 4 byte address variant of command %02x", op)
+		}
+		return append([]byte{op4, byte(addr >> 24), byte(addr >> 16), byte(addr >> 8), byte(addr)}, extra...), nil
+	}
+	return append([]byte{op, byte(addr >> 16), byte(addr >> 8), byte(addr)}, extra...), nil
+}
+
+func (f *Flash) Status() (byte, error) {
+	rx, err := f.cmd([]byte{cmdReadStatus}, 1)
+	if err != nil {
+		return 0, err
+	}
+	return rx[0], nil
+}
+
+func (f *Flash) waitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		expired := time.Now().After(deadline)
+
+		status, err := f.Status()
+		if err != nil {
+			return err
+		}
+		if status&statusBusy == 0 {
+			return nil
+		}
+		if expired {
+			return fmt.Errorf("flash still busy after %v: %w", timeout, mshal.ErrorTimeout)
+		}
+	}
+}
+
+func (f *Flash) writeEnable() error {
+	if _, err := f.cmd([]byte{cmdWriteEnable}, 0); err != nil {
+		return err
+	}
+
+	status, err := f.Status()
+	if err != nil {
+		return err
+	}
+	if status&statusWriteEnabled == 0 {
+		return fmt.Errorf("flash did not enable writing (status %02x)", status)
+	}
+	return nil
+}
+
+func (f *Flash) WriteStatus(value byte) error {
+	if err := f.writeEnable(); err != nil {
+		return err
+	}
+	if _, err := f.cmd([]byte{cmdWriteStatus, value}, 0); err != nil {
+		return err
+	}
+	return f.waitReady(f.ProgramTimeout)
+}
+
+/* Unprotect clears the block protection bits of the status register */
+func (f *Flash) Unprotect() error {
+	status, err := f.Status()
+	if err != nil {
+		return err
+	}
+	if status&statusProtect == 0 {
+		return nil
+	}
+
+	if err := f.WriteStatus(status &^ statusProtect); err != nil {
+		return err
+	}
+
+	if status, err = f.Status(); err != nil {
+		return err
+	} else if status&statusProtect != 0 {
+		return fmt.Errorf("flash protection could not be cleared (status %02x), check the WP pin", status)
+	}
+	return nil
+}
+
+func (f *Flash) checkWritable() error {
+	status, err := f.Status()
+	if err != nil {
+		return err
+	}
+	if status&statusProtect != 0 {
+		return fmt.Errorf("flash is write protected (status %02x)", status)
+	}
+	return nil
+}
+
+func (f *Flash) EraseChip() error {
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+	if err := f.writeEnable(); err != nil {
+		return err
+	}
+	if _, err := f.cmd([]byte{cmdChipErase}, 0); err != nil {
+		return err
+	}
+	return f.waitReady(f.EraseTimeout * time.Duration(f.Size/65536+1))
+}
+
+/* Erase erases the range addr..addr+length with the largest erase blocks that fit, the range
+ * must be aligned to the smallest erase block */
+func (f *Flash) Erase(addr int, length int) error {
+	if len(f.EraseTypes) == 0 {
+		return errors.New("flash erase sizes are unknown")
+	}
+
+	min := f.EraseTypes[0].Size
+	if addr%min != 0 || length%min != 0 {
+		return fmt.Errorf("erase must be aligned to %d bytes", min)
+	}
+	if addr < 0 || addr+length > f.Size {
+		return errors.New("erase range exceeds the flash")
+	}
+
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+
+	for length > 0 {
+		e := f.EraseTypes[0]
+		for _, m := range f.EraseTypes {
+			if addr%m.Size == 0 && length >= m.Size {
+				e = m
+			}
+		}
+
+		tx, err := f.addrCmd(e.Opcode, addr)
+		if err != nil {
+			return err
+		}
+		if err := f.writeEnable(); err != nil {
+			return err
+		}
+		if _, err := f.cmd(tx, 0); err != nil {
+			return err
+		}
+		if err := f.waitReady(f.EraseTimeout * time.Duration(e.Size/65536+1)); err != nil {
+			return err
+		}
+
+		addr += e.Size
+		length -= e.Size
+	}
+
+	return nil
+}
+
+func (f *Flash) read(addr int, buf []byte) error {
+	tx, err := f.addrCmd(cmdFastRead, addr, 0)
+	if err != nil {
+		return err
+	}
+	rx, err := f.cmd(tx, len(buf))
+	copy(buf, rx)
+	return err
+}
+
+/* program writes within a single page */
+func (f *Flash) program(addr int, data []byte) error {
+	tx, err := f.addrCmd(cmdPageProgram, addr, data...)
+	if err != nil {
+		return err
+	}
+	if err := f.writeEnable(); err != nil {
+		return err
+	}
+	if _, err := f.cmd(tx, 0); err != nil {
+		return err
+	}
+	return f.waitReady(f.ProgramTimeout)
+}
+
+/* write updates the smallest erase block containing addr. It is only erased if bits have to be
+ * set, and only pages that changed are programmed. */
+func (f *Flash) write(addr int, buf []byte) (int, error) {
+	if len(f.EraseTypes) == 0 {
+		return 0, errors.New("flash erase sizes are unknown")
+	}
+
+	sector := f.EraseTypes[0].Size
+	start := addr / sector * sector
+	if len(buf) > start+sector-addr {
+		buf = buf[:start+sector-addr]
+	}
+
+	old := make([]byte, sector)
+	if err := f.read(start, old); err != nil {
+		return 0, err
+	}
+
+	data := append([]byte{}, old...)
+	copy(data[addr-start:], buf)
+	if bytes.Equal(data, old) {
+		return len(buf), nil
+	}
+
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	for i := range data {
+		if old[i]&data[i] != data[i] {
+			if err := f.Erase(start, sector); err != nil {
+				return 0, err
+			}
+			old = bytes.Repeat([]byte{0xff}, sector)
+			break
+		}
+	}
+
+	for offset := 0; offset < sector; offset += f.PageSize {
+		page := data[offset : offset+f.PageSize]
+		if bytes.Equal(page, old[offset:offset+f.PageSize]) {
+			continue
+		}
+		if err := f.program(start+offset, page); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(buf), nil
+}
+
+func (f *Flash) GetName() mshal.MemoryRegionNameType {
+	return mshal.MemoryRegionSPIFlash
+}
+
+func (f *Flash) GetLength() int {
+	return f.Size
+}
+
+func (f *Flash) GetParent() (mshal.MemoryRegion, int) {
+	return nil, 0
+}
+
+func (f *Flash) GetAlignment() int {
+	return 1
+}
+
+func (f *Flash) GetPageSize() int {
+	return f.PageSize
+}
+
+func (f *Flash) Access(write bool, addr int, buf []byte) (int, error) {
+	if addr >= f.Size {
+		return 0, nil
+	}
+	if addr+len(buf) > f.Size {
+		buf = buf[:f.Size-addr]
+	}
+
+	if write {
+		return f.write(addr, buf)
+	}
+
+	if len(buf) > maxReadLen {
+		buf = buf[:maxReadLen]
+	}
+	if err := f.read(addr, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+/* Region returns the flash as a memory region that completes partial accesses */
+func (f *Flash) Region() mshal.MemoryRegion {
+	return mshal.RegionWrapCompleteIO(f)
+}